@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gookit/slog"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// A proxy started with -kubeCIDRs lists the nodes and servicecidrs, and it runs
+// with the service account of the pod it's injected into. Rather than granting
+// that to every service account, the service account of each injected pod is
+// added to the smesh-proxy ClusterRoleBinding (manifests/proxy-rbac.yaml).
+const proxyRoleBinding = "smesh-proxy"
+
+// injected is true for the pods the webhook added the proxy to
+func injected(pod *v1.Pod) bool {
+	return pod.Annotations[admissionWebhookAnnotationStatusKey] == "injected"
+}
+
+// bindProxyRole adds the pod's service account to the proxy's role binding,
+// accounts stay bound once added as other pods may still be using them
+func (i *informerHandler) bindProxyRole(pod *v1.Pod) error {
+	account := pod.Spec.ServiceAccountName
+	if account == "" {
+		account = "default"
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		bindings := i.clientset.RbacV1().ClusterRoleBindings()
+		binding, err := bindings.Get(context.TODO(), proxyRoleBinding, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to get role binding %s [%v]", proxyRoleBinding, err)
+		}
+		for _, subject := range binding.Subjects {
+			if subject.Kind == rbacv1.ServiceAccountKind && subject.Name == account && subject.Namespace == pod.Namespace {
+				return nil
+			}
+		}
+		binding.Subjects = append(binding.Subjects, rbacv1.Subject{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      account,
+			Namespace: pod.Namespace,
+		})
+		_, err = bindings.Update(context.TODO(), binding, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		slog.Infof("Bound service account %s/%s to %s", pod.Namespace, account, proxyRoleBinding)
+		return nil
+	})
+}
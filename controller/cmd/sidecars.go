@@ -1,9 +1,47 @@
 package main
 
 import (
+	"strconv"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The proxy serves /readyz on its health listener, which is set from here
+// (-healthAddress) so the probe always finds it. It is ready once the eBPF is
+// attached, the certificates are loaded and it is listening.
+const proxyHealthPort = 18092
+
+// The proxy finds its pod's cgroup in the node's cgroup hierarchy, its own
+// /sys/fs/cgroup only shows the container's cgroup (-hostCgroup). It pins its
+// eBPF objects on the node's bpffs so they outlive the container (-pinPath).
+const (
+	hostCgroupVolume = "smesh-host-cgroup"
+	hostCgroupPath   = "/host/sys/fs/cgroup"
+	bpffsVolume      = "smesh-bpffs"
+	bpffsPath        = "/sys/fs/bpf"
 )
 
+// proxyVolumes are the node paths the proxy container mounts
+func proxyVolumes() []corev1.Volume {
+	directory := corev1.HostPathDirectory
+	return []corev1.Volume{
+		{
+			Name: hostCgroupVolume,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/sys/fs/cgroup", Type: &directory},
+			},
+		},
+		{
+			Name: bpffsVolume,
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: bpffsPath, Type: &directory},
+			},
+		},
+	}
+}
+
 func smeshproxy(podname string) *corev1.Container {
 	privileged := true
 	secret := podname + "-smesh"
@@ -15,6 +53,22 @@ func smeshproxy(podname string) *corev1.Container {
 			Privileged: &privileged, // TODO: Fix permissions
 		},
 		RestartPolicy: &policy,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: hostCgroupVolume, MountPath: hostCgroupPath, ReadOnly: true},
+			{Name: bpffsVolume, MountPath: bpffsPath},
+		},
+		// A native sidecar counts as started once its probe passes, so the
+		// application containers wait until interception is live
+		StartupProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/readyz",
+					Port: intstr.FromInt32(proxyHealthPort),
+				},
+			},
+			PeriodSeconds:    1,
+			FailureThreshold: 120,
+		},
 		Env: []corev1.EnvVar{
 			{
 				Name: "SMESH-CA",
@@ -49,11 +103,81 @@ func smeshproxy(podname string) *corev1.Container {
 					},
 				},
 			},
+			{
+				Name: "SMESH_POD_UID",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.uid",
+					},
+				},
+			},
+			{
+				Name:  "SMESH_HEALTH_ADDRESS",
+				Value: ":" + strconv.Itoa(proxyHealthPort),
+			},
+			{
+				Name:  "SMESH_REQUIRE_CERTIFICATES",
+				Value: "true",
+			},
+			{
+				Name: "SMESH_PROXY_PROTOCOL_PORTS",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.annotations['" + admissionWebhookAnnotationProxyProtocolKey + "']",
+					},
+				},
+			},
+			{
+				Name: "SMESH_EXCLUDE_PORTS",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.annotations['" + admissionWebhookAnnotationExcludePortsKey + "']",
+					},
+				},
+			},
+			{
+				Name: "SMESH_INCLUDE_PORTS",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.annotations['" + admissionWebhookAnnotationIncludePortsKey + "']",
+					},
+				},
+			},
+			{
+				Name: "SMESH_INBOUND_MODE",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.annotations['" + admissionWebhookAnnotationInboundModeKey + "']",
+					},
+				},
+			},
+			{
+				Name: "SMESH_INBOUND_PORTS",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.annotations['" + admissionWebhookAnnotationInboundPortsKey + "']",
+					},
+				},
+			},
 		},
 	}
 	return c
 }
 
+// declaredPorts are the TCP ports the application containers declare, these
+// are intercepted inbound unless the pod says otherwise
+func declaredPorts(pod *corev1.Pod) string {
+	var ports []string
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol == "" || port.Protocol == corev1.ProtocolTCP {
+				ports = append(ports, strconv.Itoa(int(port.ContainerPort)))
+			}
+		}
+	}
+	return strings.Join(ports, ",")
+}
+
 // func withDebugContainer(pod *corev1.Pod) *corev1.Pod {
 // 	privileged := true
 // 	secret := pod.Name + "-smesh"
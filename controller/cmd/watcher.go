@@ -95,6 +95,14 @@ func (i *informerHandler) OnDelete(obj interface{}) {
 }
 
 func (i *informerHandler) OnAdd(obj interface{}, b bool) {
+	pod := obj.(*v1.Pod)
+	if !injected(pod) {
+		return
+	}
+	err := i.bindProxyRole(pod)
+	if err != nil {
+		slog.Error(err)
+	}
 }
 
 // -- cert management code --
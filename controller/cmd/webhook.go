@@ -29,6 +29,16 @@ var ignoredNamespaces = []string{
 const (
 	admissionWebhookAnnotationInjectKey = "sidecar-injector-webhook.thebsdbox.co.uk/inject"
 	admissionWebhookAnnotationStatusKey = "sidecar-injector-webhook.thebsdbox.co.uk/status"
+	// Comma separated application ports that should receive a PROXY protocol v2 header
+	admissionWebhookAnnotationProxyProtocolKey = "sidecar-injector-webhook.thebsdbox.co.uk/proxy-protocol-ports"
+	// Comma separated outbound ports (or ranges) that are not intercepted
+	admissionWebhookAnnotationExcludePortsKey = "sidecar-injector-webhook.thebsdbox.co.uk/exclude-ports"
+	// Comma separated outbound ports (or ranges) that are the only ones intercepted
+	admissionWebhookAnnotationIncludePortsKey = "sidecar-injector-webhook.thebsdbox.co.uk/include-ports"
+	// Inbound interception of the application ports: off, permissive or strict
+	admissionWebhookAnnotationInboundModeKey = "sidecar-injector-webhook.thebsdbox.co.uk/inbound-mode"
+	// Comma separated application ports (or ranges) whose inbound connections are intercepted, defaults to the declared container ports
+	admissionWebhookAnnotationInboundPortsKey = "sidecar-injector-webhook.thebsdbox.co.uk/inbound-ports"
 )
 
 type WebhookServer struct {
@@ -102,6 +112,27 @@ func addInitContainer(target []corev1.Container, add corev1.Container, basePath
 	return patch
 }
 
+func addVolumes(target []corev1.Volume, added []corev1.Volume, basePath string) (patch []patchOperation) {
+	first := len(target) == 0
+	for _, add := range added {
+		var value interface{}
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.Volume{add}
+		} else {
+			path = path + "/-"
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
 func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
 	for key, value := range added {
 		if target == nil || target[key] == "" {
@@ -128,13 +159,12 @@ func updateAnnotation(target map[string]string, added map[string]string) (patch
 func createPatch(pod *corev1.Pod, annotations map[string]string) ([]byte, error) {
 	var patch []patchOperation
 	// Add our init container
-	patch = append(patch, addInitContainer(pod.Spec.InitContainers, *smeshproxy(pod.Name), "/spec/initContainers")...)
+	proxy := smeshproxy(pod.Name)
+	proxy.Env = append(proxy.Env, corev1.EnvVar{Name: "SMESH_DECLARED_PORTS", Value: declaredPorts(pod)})
+	patch = append(patch, addInitContainer(pod.Spec.InitContainers, *proxy, "/spec/initContainers")...)
+	patch = append(patch, addVolumes(pod.Spec.Volumes, proxyVolumes(), "/spec/volumes")...)
 	// Stick some annotations on (TODO)
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
-	// Enable shared namespace
-	patch = append(patch, patchOperation{Op: "replace",
-		Path:  "/spec/shareProcessNamespace",
-		Value: true})
 	return json.Marshal(patch)
 }
 
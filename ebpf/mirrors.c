@@ -8,7 +8,199 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 
-extern int LINUX_KERNEL_VERSION __kconfig;
+// Set by the proxy before loading, on kernels without ring buffers or
+// sockhashes the maps are placeholders and the verifier drops the code that
+// uses them
+volatile const __u8 have_ringbuf = 1;
+volatile const __u8 have_sockhash = 1;
+
+// Sends an event to userspace, addr is in network byte order and only the
+// first word is used for AF_INET. If the ring buffer is full the event is lost.
+static __always_inline void emit_event(__u8 type, __u64 cookie, __u32 family,
+                                       __u32 *addr, __u16 port) {
+  if (!have_ringbuf)
+    return;
+  struct Event *e = bpf_ringbuf_reserve(&map_events, sizeof(*e), 0);
+  if (!e)
+    return;
+  __builtin_memset(e, 0, sizeof(*e));
+  e->type = type;
+  e->cookie = cookie;
+  e->pid = bpf_get_current_pid_tgid() >> 32;
+  e->family = family;
+  e->port = port;
+  if (addr) {
+    e->addr[0] = addr[0];
+    if (family == AF_INET6) {
+      e->addr[1] = addr[1];
+      e->addr[2] = addr[2];
+      e->addr[3] = addr[3];
+    }
+  }
+  bpf_ringbuf_submit(e, 0);
+}
+
+// Checks whether a port is set in one of the port bitmaps
+static __always_inline int port_set(void *ports, __u16 port) {
+  __u32 word = port / 64;
+  __u64 *bits = bpf_map_lookup_elem(ports, &word);
+  return bits && (*bits >> (port % 64)) & 1;
+}
+
+// Ports that are not redirected to the proxy, either they are excluded or
+// there is an include list and they aren't on it
+static __always_inline int ignored_port(struct Config *conf, __u16 dst_port) {
+  if (port_set(&map_excluded_ports, dst_port))
+    return 1;
+  if (conf->include_ports && !port_set(&map_included_ports, dst_port))
+    return 1;
+  return 0;
+}
+
+// This prevents the proxy from proxying itself, the proxy marks its own
+// sockets
+static __always_inline int is_proxy(struct Config *conf,
+                                    struct bpf_sock_addr *ctx) {
+  struct bpf_sock *sk = ctx->sk;
+  if (!sk || !conf->proxy_mark)
+    return 0;
+  return sk->mark == conf->proxy_mark;
+}
+
+// Checks if an IPv4 address (network byte order) should be intercepted
+static __always_inline int intercept4(__u32 addr) {
+  struct CIDR4 key;
+  key.prefixlen = 32;
+  key.addr = addr;
+  __u8 *action = bpf_map_lookup_elem(&map_cidrs, &key);
+  return action && *action == CIDR_INCLUDE;
+}
+
+// Checks if an IPv6 address (network byte order words) should be intercepted
+static __always_inline int intercept6(__u32 *addr) {
+  struct CIDR6 key;
+  key.prefixlen = 128;
+  key.addr[0] = addr[0];
+  key.addr[1] = addr[1];
+  key.addr[2] = addr[2];
+  key.addr[3] = addr[3];
+  __u8 *action = bpf_map_lookup_elem(&map_cidrs6, &key);
+  return action && *action == CIDR_INCLUDE;
+}
+
+// Looks up the policy for a destination, a rule for the port wins over a rule
+// for any port (0) and then the longest prefix wins. Returns 0 without a policy
+static __always_inline __u8 policy4(__u32 addr, __u16 port) {
+  struct Policy4 key;
+  __builtin_memset(&key, 0, sizeof(key));
+  key.prefixlen = 16 + 32;
+  key.port = port;
+  __builtin_memcpy(key.addr, &addr, sizeof(key.addr));
+  __u8 *action = bpf_map_lookup_elem(&map_policy, &key);
+  if (action)
+    return *action;
+  key.port = 0;
+  action = bpf_map_lookup_elem(&map_policy, &key);
+  return action ? *action : 0;
+}
+
+static __always_inline __u8 policy6(__u32 *addr, __u16 port) {
+  struct Policy6 key;
+  __builtin_memset(&key, 0, sizeof(key));
+  key.prefixlen = 16 + 128;
+  key.port = port;
+  __builtin_memcpy(key.addr, addr, sizeof(key.addr));
+  __u8 *action = bpf_map_lookup_elem(&map_policy6, &key);
+  if (action)
+    return *action;
+  key.port = 0;
+  action = bpf_map_lookup_elem(&map_policy6, &key);
+  return action ? *action : 0;
+}
+
+// Redirects a UDP datagram (or a connect() on a UDP socket) to the relay, the
+// original destination is stored where the relay can find it. An unconnected
+// socket can send to several destinations, so each one is a flow with its own
+// relay socket. Only the first datagram of a flow goes to the shared relay port
+// and until the relay has picked it up another destination can't be told apart,
+// so those datagrams fail with EPERM rather than go to the wrong place.
+static __always_inline int udp_redirect4(struct bpf_sock_addr *ctx,
+                                         int connected) {
+  __u32 key = 0;
+  struct Config *conf = bpf_map_lookup_elem(&map_config, &key);
+  if (!conf)
+    return 1;
+  if (conf->udp_proxy_port == 0)
+    return 1;
+
+  __u32 dst_addr = bpf_ntohl(ctx->user_ip4);
+  __u32 destination = ctx->user_ip4;
+  __u16 dst_port = bpf_ntohl(ctx->user_port) >> 16;
+  __u64 cookie = bpf_get_socket_cookie(ctx);
+
+  // Policies apply to datagrams the same way as to connections
+  __u8 action = policy4(ctx->user_ip4, dst_port);
+  if (action == POLICY_BYPASS)
+    return 1;
+
+  // If this datagram is not part of an intercepted range then return
+  if (!action && !intercept4(ctx->user_ip4))
+    return 1;
+
+  if (is_proxy(conf, ctx))
+    return 1;
+
+  // Failing the hook makes sendmsg() or connect() return EPERM
+  if (action == POLICY_DENY) {
+    emit_event(EVENT_DENIED, cookie, AF_INET, &destination, dst_port);
+    return 0;
+  }
+
+  // Leave DNS alone, it is far too important to break
+  if (conf->exclude_dns && dst_port == DNS_PORT)
+    return 1;
+
+  if (ignored_port(conf, dst_port))
+    return 1;
+
+  __u64 now = bpf_ktime_get_ns();
+  if (!connected) {
+    struct UDPFlow flow;
+    __builtin_memset(&flow, 0, sizeof(flow));
+    flow.cookie = cookie;
+    flow.addr = dst_addr;
+    flow.port = dst_port;
+    __u16 *relay_port = bpf_map_lookup_elem(&map_udp_flows, &flow);
+    if (relay_port) {
+      ctx->user_ip4 = bpf_htonl(conf->proxy_addr);
+      ctx->user_port = bpf_htonl(*relay_port << 16);
+      return 1;
+    }
+
+    struct Destination *pending = bpf_map_lookup_elem(&map_udp_socks, &cookie);
+    if (pending && !pending->connected &&
+        (pending->addr != dst_addr || pending->port != dst_port) &&
+        pending->time && now - pending->time < UDP_SETUP_NS) {
+      flow.addr = pending->addr;
+      flow.port = pending->port;
+      if (!bpf_map_lookup_elem(&map_udp_flows, &flow))
+        return 0;
+    }
+  }
+
+  struct Destination dst;
+  __builtin_memset(&dst, 0, sizeof(dst));
+  dst.addr = dst_addr;
+  dst.port = dst_port;
+  dst.connected = connected;
+  dst.time = now;
+  bpf_map_update_elem(&map_udp_socks, &cookie, &dst, 0);
+
+  // Redirect the datagram to the UDP relay
+  ctx->user_ip4 = bpf_htonl(conf->proxy_addr);
+  ctx->user_port = bpf_htonl(conf->udp_proxy_port << 16);
+  return 1;
+}
 
 // This hook is triggered when a process (inside the cgroup where this is
 // attached) calls the connect() syscall It redirect the connection to the
@@ -16,9 +208,11 @@ extern int LINUX_KERNEL_VERSION __kconfig;
 // map_socks
 SEC("cgroup/connect4")
 int cg_connect4(struct bpf_sock_addr *ctx) {
-  // Only forward IPv4 TCP connections
+  // Only forward IPv4 TCP connections and connected UDP sockets
   if (ctx->user_family != AF_INET)
     return 1;
+  if (ctx->type == SOCK_DGRAM && ctx->protocol == IPPROTO_UDP)
+    return udp_redirect4(ctx, 1);
   if (ctx->protocol != IPPROTO_TCP)
     return 1;
 
@@ -30,67 +224,44 @@ int cg_connect4(struct bpf_sock_addr *ctx) {
   // This field contains the IPv4 address passed to the connect() syscall
   // a.k.a. connect to this socket destination address and port
   __u32 dst_addr = bpf_ntohl(ctx->user_ip4);
-  __u32 destination = bpf_ntohl(dst_addr);
-
-  int mask = (-1) << (32 - conf->mask);
-  // bpf_printk("hex 0x%x 0x%x 0x%x", bpf_htonl(ctx->user_ip4), mask,
-  //            conf->network);
-  //bpf_printk("IP in bounds %pI4", &destination);
-
-  // If this packet is not part of the podCIDR range then return
-  if ((bpf_htonl(ctx->user_ip4) & mask) != conf->network) {
-    return 1;
-  }
-  // bpf_printk("IP in bounds %pI4 %pI4 %pI4", &destination, &start, &end);
-
-  // bpf_printk("IP out of bounds %u %u %u", destination, start, end);
-  // bpf_printk("IP out of bounds %pI4 %pI4 %pI4", &destination, &start, &end);
-  // if (destination < conf->start_addr || destination > conf->end_addr) {
-
-  //   // bpf_printk("IP out of bounds %pI4 %pI4 %pI4", &destination, &start,
-  //   // &end);
-  //   return 1;
-  // }
+  __u32 destination = ctx->user_ip4;
 
   // This field contains the port number passed to the connect() syscall
   __u16 dst_port = bpf_ntohl(ctx->user_port) >> 16;
-  //__u64 pid = (bpf_get_current_pid_tgid() >> 32);
 
-  // This prevents the proxy from proxying itself
-  // pid_t pid2 = get_ns_pid();
-
-  struct task_struct *task = (struct task_struct *)bpf_get_current_task();
-
-  int ns_pid = 0;
-  int ns_ppid = 0;
-  __u32 pid_ns_id = 0;
-
-  ns_pid_ppid(task, &ns_pid, &ns_ppid, &pid_ns_id);
+  // Unique identifier for the destination socket
+  __u64 cookie = bpf_get_socket_cookie(ctx);
 
-  // Wrap this message as it has two many arguments for older kernels (invalid
-  // func unknown#177)
-  //if (LINUX_KERNEL_VERSION > KERNEL_VERSION(6, 8, 0)) {
-   // bpf_printk("[%d vs %d] incoming %pI4:%d", conf->proxy_pid, ns_pid,
-   //            &destination, dst_port);
-  //} else {
-    bpf_printk("[%d vs %d] incoming %pI4", conf->proxy_pid, ns_pid,
-               &destination);
-  //}
+  // A policy overrides the intercepted ranges (but not the excluded ports)
+  __u8 action = policy4(ctx->user_ip4, dst_port);
+  if (action == POLICY_BYPASS) {
+    emit_event(EVENT_BYPASSED, cookie, AF_INET, &destination, dst_port);
+    return 1;
+  }
 
-  if (ns_pid == conf->proxy_pid)
+  // If this packet is not part of an intercepted range then return
+  if (!action && !intercept4(ctx->user_ip4)) {
+    if (conf->debug)
+      emit_event(EVENT_BYPASSED, cookie, AF_INET, &destination, dst_port);
     return 1;
+  }
 
-  if (dst_port == 8080 || dst_port == 8181) {
-    // kubelet readiness probes (eyeroll)
+  // This prevents the proxy from proxying itself
+  if (is_proxy(conf, ctx))
     return 1;
+
+  // Failing the hook makes connect() return EPERM
+  if (action == POLICY_DENY) {
+    emit_event(EVENT_DENIED, cookie, AF_INET, &destination, dst_port);
+    return 0;
   }
 
-  if (dst_port == 18000 || dst_port == 18001) {
-    bpf_printk("Ignoring cluster to cluster");
+  // Excluded ports win over a redirect policy, the proxy's own ports are
+  // always excluded
+  if (ignored_port(conf, dst_port)) {
+    emit_event(EVENT_BYPASSED, cookie, AF_INET, &destination, dst_port);
     return 1;
   }
-  // Unique identifier for the destination socket
-  __u64 cookie = bpf_get_socket_cookie(ctx);
 
   // Store destination socket under cookie key
   struct Socket sock;
@@ -101,55 +272,357 @@ int cg_connect4(struct bpf_sock_addr *ctx) {
 
   // Redirect the connection to the proxy
   ctx->user_ip4 = bpf_htonl(conf->proxy_addr);
-  // ctx->user_ip4 = bpf_htonl(0x7f000001);              // 127.0.0.1 == proxy
-  // IP
   ctx->user_port = bpf_htonl(conf->proxy_port << 16); // Proxy port
 
-  __u32 source = ctx->user_ip4;
-  // if (LINUX_KERNEL_VERSION > KERNEL_VERSION(6, 8, 0)) {
+  emit_event(EVENT_REDIRECTED, cookie, AF_INET, &destination, dst_port);
+  return 1;
+}
+
+// The IPv6 version of cg_connect4, the original destination is stored in
+// map_socks6. IPv4-mapped addresses (::ffff:a.b.c.d) from dual-stack sockets
+// are really IPv4 connections, so they are matched against the IPv4 prefixes,
+// stored in map_socks and redirected to the mapped IPv4 proxy address.
+SEC("cgroup/connect6")
+int cg_connect6(struct bpf_sock_addr *ctx) {
+  if (ctx->user_family != AF_INET6)
+    return 1;
+  if (ctx->protocol != IPPROTO_TCP)
+    return 1;
+
+  __u32 key = 0;
+  struct Config *conf = bpf_map_lookup_elem(&map_config, &key);
+  if (!conf)
+    return 1;
+
+  __u32 dst_addr[4];
+  dst_addr[0] = ctx->user_ip6[0];
+  dst_addr[1] = ctx->user_ip6[1];
+  dst_addr[2] = ctx->user_ip6[2];
+  dst_addr[3] = ctx->user_ip6[3];
+  __u16 dst_port = bpf_ntohl(ctx->user_port) >> 16;
+
+  __u64 cookie = bpf_get_socket_cookie(ctx);
+
+  int mapped = dst_addr[0] == 0 && dst_addr[1] == 0 &&
+               dst_addr[2] == bpf_htonl(0x0000ffff);
+  __u8 action;
+  if (mapped)
+    action = policy4(dst_addr[3], dst_port);
+  else
+    action = policy6(dst_addr, dst_port);
+  if (action == POLICY_BYPASS) {
+    emit_event(EVENT_BYPASSED, cookie, AF_INET6, dst_addr, dst_port);
+    return 1;
+  }
+
+  if (!action) {
+    if ((mapped && !intercept4(dst_addr[3])) ||
+        (!mapped && !intercept6(dst_addr))) {
+      if (conf->debug)
+        emit_event(EVENT_BYPASSED, cookie, AF_INET6, dst_addr, dst_port);
+      return 1;
+    }
+  }
+
+  if (is_proxy(conf, ctx))
+    return 1;
+
+  if (action == POLICY_DENY) {
+    emit_event(EVENT_DENIED, cookie, AF_INET6, dst_addr, dst_port);
+    return 0;
+  }
+
+  if (ignored_port(conf, dst_port)) {
+    emit_event(EVENT_BYPASSED, cookie, AF_INET6, dst_addr, dst_port);
+    return 1;
+  }
+
+  if (mapped) {
+    struct Socket sock;
+    __builtin_memset(&sock, 0, sizeof(sock));
+    sock.dst_addr = bpf_ntohl(dst_addr[3]);
+    sock.dst_port = dst_port;
+    bpf_map_update_elem(&map_socks, &cookie, &sock, 0);
+
+    ctx->user_ip6[3] = bpf_htonl(conf->proxy_addr);
+  } else {
+    struct Socket6 sock;
+    __builtin_memset(&sock, 0, sizeof(sock));
+    sock.dst_addr[0] = dst_addr[0];
+    sock.dst_addr[1] = dst_addr[1];
+    sock.dst_addr[2] = dst_addr[2];
+    sock.dst_addr[3] = dst_addr[3];
+    sock.dst_port = dst_port;
+    bpf_map_update_elem(&map_socks6, &cookie, &sock, 0);
+
+    ctx->user_ip6[0] = conf->proxy_addr6[0];
+    ctx->user_ip6[1] = conf->proxy_addr6[1];
+    ctx->user_ip6[2] = conf->proxy_addr6[2];
+    ctx->user_ip6[3] = conf->proxy_addr6[3];
+  }
+  ctx->user_port = bpf_htonl(conf->proxy_port << 16); // Proxy port
+
+  emit_event(EVENT_REDIRECTED, cookie, AF_INET6, dst_addr, dst_port);
+  return 1;
+}
+
+// This hook is triggered when a process sends a UDP datagram with an address
+// (sendto() or sendmsg()), the kernel doesn't run it for send() on a connected
+// socket, those are redirected once by cg_connect4. There is no IPv6 version,
+// the relay only speaks IPv4 so IPv6 UDP (and IPv4-mapped addresses on
+// dual-stack sockets) is never intercepted.
+SEC("cgroup/sendmsg4")
+int cg_sendmsg4(struct bpf_sock_addr *ctx) {
+  if (ctx->type != SOCK_DGRAM)
+    return 1;
+  if (ctx->protocol != IPPROTO_UDP)
+    return 1;
+  return udp_redirect4(ctx, 0);
+}
+
+// This hook is triggered when a process receives a UDP datagram. Replies from
+// the UDP relay come from a port that the proxy has registered in
+// map_udp_replies, or from the relay's own port for a connected socket, so we
+// rewrite the source back to the original destination and the application
+// never knows the relay was there.
+SEC("cgroup/recvmsg4")
+int cg_recvmsg4(struct bpf_sock_addr *ctx) {
+  if (ctx->type != SOCK_DGRAM)
+    return 1;
+
+  __u32 key = 0;
+  struct Config *conf = bpf_map_lookup_elem(&map_config, &key);
+  if (!conf)
+    return 1;
+  if (bpf_ntohl(ctx->user_ip4) != conf->proxy_addr)
+    return 1;
+
+  __u16 src_port = bpf_ntohl(ctx->user_port) >> 16;
+  struct Destination *dst;
+  if (src_port == conf->udp_proxy_port) {
+    __u64 cookie = bpf_get_socket_cookie(ctx);
+    dst = bpf_map_lookup_elem(&map_udp_socks, &cookie);
+    if (!dst || !dst->connected)
+      return 1;
+  } else {
+    dst = bpf_map_lookup_elem(&map_udp_replies, &src_port);
+    if (!dst)
+      return 1;
+  }
 
-  //   bpf_printk("New Connect() [%d] %pI4:%d to %pI4:%d", cookie, &destination,
-  //              dst_port, &source, bpf_ntohs(ctx->user_port));
-  // } else {
-    bpf_printk("New Connect() %pI4 to %pI4:%d", &destination, &source,
-               bpf_ntohs(ctx->user_port));
-  //}
+  ctx->user_ip4 = bpf_htonl(dst->addr);
+  ctx->user_port = bpf_htonl(dst->port << 16);
   return 1;
 }
 
+// IPv4-mapped IPv6 addresses are stored as IPv4, so a dual-stack application
+// socket and the proxy's IPv4 socket agree on the tuple
+static __always_inline void normalize_tuple(struct Tuple *t) {
+  if (t->family != AF_INET6)
+    return;
+  if (t->src_addr[0] || t->src_addr[1] ||
+      t->src_addr[2] != bpf_htonl(0x0000ffff))
+    return;
+  if (t->dst_addr[0] || t->dst_addr[1] ||
+      t->dst_addr[2] != bpf_htonl(0x0000ffff))
+    return;
+  t->family = AF_INET;
+  t->src_addr[0] = t->src_addr[3];
+  t->dst_addr[0] = t->dst_addr[3];
+  t->src_addr[2] = 0;
+  t->dst_addr[2] = 0;
+  t->src_addr[3] = 0;
+  t->dst_addr[3] = 0;
+}
+
+// Builds the tuple for a connection to the proxy, local is the application
+// side for the active socket and the proxy side for the passive one
+static __always_inline void sock_ops_tuple(struct bpf_sock_ops *ctx,
+                                           struct Tuple *t, int active) {
+  __u32 local[4] = {0, 0, 0, 0};
+  __u32 remote[4] = {0, 0, 0, 0};
+  if (ctx->family == AF_INET) {
+    local[0] = ctx->local_ip4;
+    remote[0] = ctx->remote_ip4;
+  } else {
+    local[0] = ctx->local_ip6[0];
+    local[1] = ctx->local_ip6[1];
+    local[2] = ctx->local_ip6[2];
+    local[3] = ctx->local_ip6[3];
+    remote[0] = ctx->remote_ip6[0];
+    remote[1] = ctx->remote_ip6[1];
+    remote[2] = ctx->remote_ip6[2];
+    remote[3] = ctx->remote_ip6[3];
+  }
+  __u16 local_port = ctx->local_port;
+  __u16 remote_port = bpf_ntohl(ctx->remote_port);
+
+  __builtin_memset(t, 0, sizeof(*t));
+  t->family = ctx->family;
+  if (active) {
+    __builtin_memcpy(t->src_addr, local, sizeof(local));
+    __builtin_memcpy(t->dst_addr, remote, sizeof(remote));
+    t->src_port = local_port;
+    t->dst_port = remote_port;
+  } else {
+    __builtin_memcpy(t->src_addr, remote, sizeof(remote));
+    __builtin_memcpy(t->dst_addr, local, sizeof(local));
+    t->src_port = remote_port;
+    t->dst_port = local_port;
+  }
+  normalize_tuple(t);
+}
+
+// Adds a socket to map_sock_hash (keyed local to remote) when the fast path is
+// enabled, sockets are removed from it automatically when they close
+static __always_inline void add_fast_path(struct bpf_sock_ops *ctx,
+                                          struct Tuple *t) {
+  if (!have_sockhash)
+    return;
+  __u32 key = 0;
+  struct Config *conf = bpf_map_lookup_elem(&map_config, &key);
+  if (!conf || !conf->fast_path)
+    return;
+  bpf_sock_hash_update(ctx, &map_sock_hash, t, BPF_NOEXIST);
+}
+
 // This program is called whenever there's a socket operation on a particular
-// cgroup (retransmit timeout, connection establishment, etc.) This is just to
-// record client source address and port after succesful connection
-// establishment to the proxy
+// cgroup (retransmit timeout, connection establishment, etc.) This records the
+// application's connection to the proxy (and its source address and port) when
+// it is established, and links the proxy's accepted socket to it
 SEC("sockops")
 int cg_sock_ops(struct bpf_sock_ops *ctx) {
-  // Only forward on IPv4 connections
-  if (ctx->family != AF_INET)
+  if (ctx->family != AF_INET && ctx->family != AF_INET6)
     return 0;
 
+  struct Tuple tuple;
+
   // Active socket with an established connection
   if (ctx->op == BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB) {
     __u64 cookie = bpf_get_socket_cookie(ctx);
 
     // Lookup the socket in the map for the corresponding cookie
-    // In case the socket is present, store the source port and socket mapping
+    // In case the socket is present, record the source and the tuple
+    sock_ops_tuple(ctx, &tuple, 1);
     struct Socket *sock = bpf_map_lookup_elem(&map_socks, &cookie);
     if (sock) {
-      __u16 src_port = ctx->local_port;
-      bpf_map_update_elem(&map_ports, &src_port, &cookie, 0);
+      sock->src_addr = bpf_ntohl(tuple.src_addr[0]);
+      sock->src_port = tuple.src_port;
+      bpf_map_update_elem(&map_ports, &tuple, &cookie, 0);
+      // Tell us when the connection closes so the entries can be removed
+      bpf_sock_ops_cb_flags_set(ctx, BPF_SOCK_OPS_STATE_CB_FLAG);
+      add_fast_path(ctx, &tuple);
+      return 0;
+    }
+    struct Socket6 *sock6 = bpf_map_lookup_elem(&map_socks6, &cookie);
+    if (sock6) {
+      __builtin_memcpy(sock6->src_addr, tuple.src_addr, sizeof(tuple.src_addr));
+      sock6->src_port = tuple.src_port;
+      bpf_map_update_elem(&map_ports, &tuple, &cookie, 0);
+      bpf_sock_ops_cb_flags_set(ctx, BPF_SOCK_OPS_STATE_CB_FLAG);
+      add_fast_path(ctx, &tuple);
+    }
+  }
+
+  // The proxy accepted a connection, if it came from an intercepted socket
+  // then link the two cookies
+  if (ctx->op == BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB) {
+    sock_ops_tuple(ctx, &tuple, 0);
+    __u64 *app_cookie = bpf_map_lookup_elem(&map_ports, &tuple);
+    if (app_cookie) {
+      __u64 cookie = bpf_get_socket_cookie(ctx);
+      bpf_map_update_elem(&map_proxy_socks, &cookie, app_cookie, 0);
+      bpf_sock_ops_cb_flags_set(ctx, BPF_SOCK_OPS_STATE_CB_FLAG);
+      // The proxy's socket is keyed from its own side
+      sock_ops_tuple(ctx, &tuple, 1);
+      add_fast_path(ctx, &tuple);
     }
-    __u32 destination = ctx->local_ip4;
+  }
 
-    // bpf_printk("sockops hook successful %pI4:%d", &destination,
-    //           ctx->local_port);
+  // A connection we're tracking has closed, args[1] is the new state. Only
+  // one of the application or proxy entries will exist for a cookie.
+  if (ctx->op == BPF_SOCK_OPS_STATE_CB && ctx->args[1] == BPF_TCP_CLOSE) {
+    __u64 cookie = bpf_get_socket_cookie(ctx);
+    if (bpf_map_delete_elem(&map_proxy_socks, &cookie) == 0)
+      return 0;
+    int socks = bpf_map_delete_elem(&map_socks, &cookie);
+    int socks6 = bpf_map_delete_elem(&map_socks6, &cookie);
+    if (socks == 0 || socks6 == 0) {
+      sock_ops_tuple(ctx, &tuple, 1);
+      bpf_map_delete_elem(&map_ports, &tuple);
+    }
   }
 
   return 0;
 }
 
+// Finds the application socket cookie for a socket accepted by the proxy
+static __always_inline __u64 *sock_opt_cookie(struct bpf_sockopt *ctx) {
+  struct bpf_sock *sk = ctx->sk;
+  struct Tuple t;
+  __builtin_memset(&t, 0, sizeof(t));
+  t.family = sk->family;
+  if (sk->family == AF_INET) {
+    t.src_addr[0] = sk->dst_ip4;
+    t.dst_addr[0] = sk->src_ip4;
+  } else {
+    t.src_addr[0] = sk->dst_ip6[0];
+    t.src_addr[1] = sk->dst_ip6[1];
+    t.src_addr[2] = sk->dst_ip6[2];
+    t.src_addr[3] = sk->dst_ip6[3];
+    t.dst_addr[0] = sk->src_ip6[0];
+    t.dst_addr[1] = sk->src_ip6[1];
+    t.dst_addr[2] = sk->src_ip6[2];
+    t.dst_addr[3] = sk->src_ip6[3];
+  }
+  // It's actually sk->dst_port because getsockopt() syscall with
+  // SO_ORIGINAL_DST socket option is retrieving the original dst port of the
+  // client so it's "querying" the destination port of the client
+  t.src_port = bpf_ntohs(sk->dst_port);
+  t.dst_port = sk->src_port;
+  normalize_tuple(&t);
+  return bpf_map_lookup_elem(&map_ports, &t);
+}
+
+// IPv6 connections to the proxy get the original destination from map_socks6
+// as a sockaddr_in6
+static __always_inline int original_dst6(struct bpf_sockopt *ctx) {
+  __u64 *cookie = sock_opt_cookie(ctx);
+  if (!cookie) {
+    emit_event(EVENT_LOOKUP_MISS, 0, AF_INET6, 0, 0);
+    return 1;
+  }
+
+  struct Socket6 *sock = bpf_map_lookup_elem(&map_socks6, cookie);
+  if (!sock) {
+    emit_event(EVENT_LOOKUP_MISS, *cookie, AF_INET6, 0, 0);
+    return 1;
+  }
+
+  struct sockaddr_in6 *sa = ctx->optval;
+  if ((void *)(sa + 1) > ctx->optval_end)
+    return 1;
+
+  ctx->optlen = sizeof(*sa);
+  sa->sin6_family = AF_INET6;
+  sa->sin6_port = bpf_htons(sock->dst_port);
+  sa->sin6_flowinfo = 0;
+  sa->sin6_addr.in6_u.u6_addr32[0] = sock->dst_addr[0];
+  sa->sin6_addr.in6_u.u6_addr32[1] = sock->dst_addr[1];
+  sa->sin6_addr.in6_u.u6_addr32[2] = sock->dst_addr[2];
+  sa->sin6_addr.in6_u.u6_addr32[3] = sock->dst_addr[3];
+  sa->sin6_scope_id = 0;
+  ctx->retval = 0;
+
+  emit_event(EVENT_LOOKUP_HIT, *cookie, AF_INET6, sock->dst_addr,
+             sock->dst_port);
+  return 1;
+}
+
 // This is triggered when the proxy queries the original destination
 // information through getsockopt SO_ORIGINAL_DST. This program uses the
-// source port of the client to retrieve the socket's cookie from map_ports,
+// full tuple of the client's connection to retrieve the socket's cookie from
+// map_ports,
 // and then from map_socks to get the original destination information, then
 // establishes a connection with the original target and forwards the client's
 // request.
@@ -162,30 +635,30 @@ int cg_sock_opt(struct bpf_sockopt *ctx) {
   // proxy server, upon receiving the packets, often needs to know the
   // original destination address in order to handle the traffic
   // appropriately. This is where SO_ORIGINAL_DST comes into play.
+  // IP6T_SO_ORIGINAL_DST is also 80
   if (ctx->optname != 80)
     return 1;
-  // Only forward IPv4 TCP connections
-  if (ctx->sk->family != AF_INET)
-    return 1;
   if (ctx->sk->protocol != IPPROTO_TCP)
     return 1;
+  if (ctx->sk->family == AF_INET6)
+    return original_dst6(ctx);
+  if (ctx->sk->family != AF_INET)
+    return 1;
 
-  // Get the clients source port
-  // It's actually sk->dst_port because getsockopt() syscall with
-  // SO_ORIGINAL_DST socket option is retrieving the original dst port of the
-  // client so it's "querying" the destination port of the client
-  __u16 src_port = bpf_ntohs(ctx->sk->dst_port);
-
-  // Retrieve the socket cookie using the clients' src_port
-  __u64 *cookie = bpf_map_lookup_elem(&map_ports, &src_port);
-  if (!cookie)
+  // Retrieve the socket cookie using the clients' connection
+  __u64 *cookie = sock_opt_cookie(ctx);
+  if (!cookie) {
+    emit_event(EVENT_LOOKUP_MISS, 0, AF_INET, 0, 0);
     return 1;
+  }
 
   // Using the cookie (socket identifier), retrieve the original socket
   // (client connect to destination) from map_socks
   struct Socket *sock = bpf_map_lookup_elem(&map_socks, cookie);
-  if (!sock)
+  if (!sock) {
+    emit_event(EVENT_LOOKUP_MISS, *cookie, AF_INET, 0, 0);
     return 1;
+  }
 
   struct sockaddr_in *sa = ctx->optval;
   if ((void *)(sa + 1) > ctx->optval_end)
@@ -199,11 +672,86 @@ int cg_sock_opt(struct bpf_sockopt *ctx) {
   ctx->retval = 0;
   __u32 address = sa->sin_addr.s_addr;
 
-  if (LINUX_KERNEL_VERSION > KERNEL_VERSION(6, 8, 0)) {
-    bpf_printk("Redirecting %pI4:%d %d", &address, bpf_ntohs(sa->sin_port),
-               ctx->sk->src_port);
-  }
+  emit_event(EVENT_LOOKUP_HIT, *cookie, AF_INET, &address, sock->dst_port);
   return 1;
 }
 
+// Connections from inside the pod (the proxy dialing the application, or the
+// application talking to itself) are left alone
+static __always_inline int local_peer(struct bpf_sk_lookup *ctx) {
+  if (ctx->family == AF_INET) {
+    if ((bpf_ntohl(ctx->local_ip4) >> 24) == 127)
+      return 1;
+    return ctx->remote_ip4 == ctx->local_ip4;
+  }
+  if (ctx->local_ip6[0] == 0 && ctx->local_ip6[1] == 0 &&
+      ctx->local_ip6[2] == 0 && ctx->local_ip6[3] == bpf_htonl(1))
+    return 1;
+  return ctx->remote_ip6[0] == ctx->local_ip6[0] &&
+         ctx->remote_ip6[1] == ctx->local_ip6[1] &&
+         ctx->remote_ip6[2] == ctx->local_ip6[2] &&
+         ctx->remote_ip6[3] == ctx->local_ip6[3];
+}
+
+// Steers inbound connections for the application ports to the proxy's inbound
+// listener, which decides whether they are allowed (PERMISSIVE) or not
+// (STRICT). If anything goes wrong the normal socket lookup happens, unless we
+// are STRICT where the connection is dropped instead of reaching the
+// application.
+SEC("sk_lookup")
+int sk_lookup_inbound(struct bpf_sk_lookup *ctx) {
+  if (ctx->protocol != IPPROTO_TCP)
+    return SK_PASS;
+
+  __u16 port = ctx->local_port; // Host byte order
+  if (!port_set(&map_inbound_ports, port))
+    return SK_PASS;
+
+  if (local_peer(ctx))
+    return SK_PASS;
+
+  __u32 key = 0;
+  struct Config *conf = bpf_map_lookup_elem(&map_config, &key);
+  int strict = conf && conf->inbound_strict;
+
+  struct bpf_sock *sk = bpf_map_lookup_elem(&map_inbound_listener, &key);
+  if (!sk)
+    return strict ? SK_DROP : SK_PASS;
+  long err = bpf_sk_assign(ctx, sk, 0);
+  bpf_sk_release(sk);
+  if (err && strict)
+    return SK_DROP;
+  return SK_PASS;
+}
+
+// Runs when an application or proxy socket in map_sock_hash sends, the data is
+// put straight onto the peer socket's receive queue instead of going through
+// the loopback TCP stack. If the peer isn't in the map yet it is sent normally.
+SEC("sk_msg")
+int sk_msg_fast_path(struct sk_msg_md *msg) {
+  struct Tuple peer;
+  __builtin_memset(&peer, 0, sizeof(peer));
+  peer.family = msg->family;
+  // The peer's tuple is ours reversed
+  if (msg->family == AF_INET) {
+    peer.src_addr[0] = msg->remote_ip4;
+    peer.dst_addr[0] = msg->local_ip4;
+  } else {
+    peer.src_addr[0] = msg->remote_ip6[0];
+    peer.src_addr[1] = msg->remote_ip6[1];
+    peer.src_addr[2] = msg->remote_ip6[2];
+    peer.src_addr[3] = msg->remote_ip6[3];
+    peer.dst_addr[0] = msg->local_ip6[0];
+    peer.dst_addr[1] = msg->local_ip6[1];
+    peer.dst_addr[2] = msg->local_ip6[2];
+    peer.dst_addr[3] = msg->local_ip6[3];
+  }
+  peer.src_port = bpf_ntohl(msg->remote_port);
+  peer.dst_port = msg->local_port;
+  normalize_tuple(&peer);
+
+  bpf_msg_redirect_hash(msg, &map_sock_hash, &peer, BPF_F_INGRESS);
+  return SK_PASS;
+}
+
 char __LICENSE[] SEC("license") = "GPL";
\ No newline at end of file
@@ -6,17 +6,43 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 
+// Maps (apart from map_events) are pinned by name under the proxy's pin path,
+// so their state survives the proxy restarting
 #define MAX_CONNECTIONS 20000
-#define AF_INET 2 /* IP protocol family.  */
-#define BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB 4
+#define MAX_CIDRS 1024
+#define MAX_POLICIES 1024
+#define AF_INET 2   /* IP protocol family.  */
+#define AF_INET6 10 /* IP version 6.  */
+#define DNS_PORT 53
+#define PORT_WORDS (65536 / 64) // Port bitmaps have a bit for every port
 
 struct Config {
   __u32 proxy_addr;
   __u16 proxy_port;
-  __u64 proxy_pid;
-  __u32 network;
-  __u16 mask;
-  __u8 debug;
+  __u32 proxy_mark; // SO_MARK on the proxy's own sockets
+  __u8 debug; // Send events for connections outside the intercepted ranges
+  __u16 udp_proxy_port; // 0 disables UDP interception
+  __u8 exclude_dns;     // Don't intercept UDP to port 53
+  __u8 include_ports;   // Only intercept ports in map_included_ports
+  __u8 fast_path;       // Add connections to the proxy to map_sock_hash
+  __u32 proxy_addr6[4]; // Network byte order
+  __u8 inbound_strict;  // Drop inbound connections the proxy can't be given
+};
+
+// Actions for a prefix in map_cidrs and map_cidrs6, the longest matching
+// prefix wins so an exclude inside an include carves out an exception
+#define CIDR_INCLUDE 1
+#define CIDR_EXCLUDE 2
+
+// LPM trie keys, the prefix length has to come first
+struct CIDR4 {
+  __u32 prefixlen;
+  __u32 addr; // Network byte order
+};
+
+struct CIDR6 {
+  __u32 prefixlen;
+  __u32 addr[4]; // Network byte order
 };
 
 struct Socket {
@@ -26,132 +52,241 @@ struct Socket {
   __u16 dst_port;
 };
 
+struct Socket6 {
+  __u32 src_addr[4]; // Network byte order
+  __u32 dst_addr[4]; // Network byte order
+  __u16 src_port;
+  __u16 dst_port;
+};
+
+// The connection between the application and the proxy, as seen from the
+// application. IPv4 (and IPv4-mapped IPv6) addresses only use addr[0].
+struct Tuple {
+  __u32 family;
+  __u32 src_addr[4]; // Network byte order
+  __u32 dst_addr[4]; // Network byte order
+  __u16 src_port;
+  __u16 dst_port;
+};
+
+// Original destination of a UDP datagram
+struct Destination {
+  __u32 addr;
+  __u16 port;
+  __u8 connected; // Set by connect(), every datagram goes to this destination
+  __u64 time;     // When it was stored, 0 once the relay has read it
+};
+
+// A UDP flow, an application socket and one of its destinations
+struct UDPFlow {
+  __u64 cookie;
+  __u32 addr;
+  __u16 port;
+};
+
+// How long the relay gets to read the first datagram of a flow
+#define UDP_SETUP_NS (5ULL * 1000000000)
+
 struct {
   __uint(type, BPF_MAP_TYPE_ARRAY);
   __uint(max_entries, 1);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
   __type(key, __u32);
   __type(value, struct Config);
 } map_config SEC(".maps");
 
+// Events sent to the proxy through map_events
+#define EVENT_REDIRECTED 1  // connect() sent to the proxy
+#define EVENT_BYPASSED 2    // connect() left alone
+#define EVENT_DENIED 3      // connect() failed by a policy
+#define EVENT_LOOKUP_HIT 4  // original destination found for the proxy
+#define EVENT_LOOKUP_MISS 5 // original destination not found for the proxy
+
+struct Event {
+  __u64 cookie;
+  __u32 pid;
+  __u32 family;
+  __u32 addr[4]; // Network byte order, IPv4 only uses addr[0]
+  __u16 port;
+  __u8 type;
+};
+
 struct {
-  __uint(type, BPF_MAP_TYPE_HASH);
-  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 256 * 1024);
+} map_events SEC(".maps");
+
+// Destination prefixes that are (or aren't) intercepted, maintained by the
+// proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, MAX_CIDRS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, struct CIDR4);
+  __type(value, __u8);
+} map_cidrs SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, MAX_CIDRS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, struct CIDR6);
+  __type(value, __u8);
+} map_cidrs6 SEC(".maps");
+
+// Actions for a destination in map_policy and map_policy6
+#define POLICY_REDIRECT 1 // Always send to the proxy
+#define POLICY_BYPASS 2   // Never send to the proxy
+#define POLICY_DENY 3     // Fail the connect()
+
+// LPM trie keys for the policy maps, the port (0 for any port) is always
+// matched in full so the prefix length is 16 + the address prefix length
+struct Policy4 {
+  __u32 prefixlen;
+  __u16 port;
+  __u8 addr[4]; // Network byte order
+};
+
+struct Policy6 {
+  __u32 prefixlen;
+  __u16 port;
+  __u8 addr[16]; // Network byte order
+};
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, MAX_POLICIES);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, struct Policy4);
+  __type(value, __u8);
+} map_policy SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, MAX_POLICIES);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __type(key, struct Policy6);
+  __type(value, __u8);
+} map_policy6 SEC(".maps");
+
+// The port maps are bitmaps, port N is bit N % 64 of word N / 64, so any number
+// of ports (and ranges) fit
+
+// Destination ports that are never intercepted, maintained by the proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, PORT_WORDS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
   __type(key, __u32);
+  __type(value, __u64);
+} map_excluded_ports SEC(".maps");
+
+// Destination ports that are intercepted when include_ports is set
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, PORT_WORDS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u32);
+  __type(value, __u64);
+} map_included_ports SEC(".maps");
+
+// Application ports whose inbound connections are steered to the proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, PORT_WORDS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u32);
+  __type(value, __u64);
+} map_inbound_ports SEC(".maps");
+
+// The proxy's inbound listener (key 0), maintained by the proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_SOCKMAP);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, __u64);
+} map_inbound_listener SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u64);
   __type(value, struct Socket);
 } map_socks SEC(".maps");
 
 struct {
-  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
   __uint(max_entries, MAX_CONNECTIONS);
-  __type(key, __u16);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u64);
+  __type(value, struct Socket6);
+} map_socks6 SEC(".maps");
+
+// The socket maps are cleaned up when connections close, they are LRU maps so
+// that sockets which never connect (or are missed) can't fill them up
+
+// Cookie of the application socket for each connection to the proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, struct Tuple);
   __type(value, __u64);
 } map_ports SEC(".maps");
 
-// struct pid_namespace *get_task_pid_ns(const struct task_struct *task);
-// struct pid *get_task_pid_ptr(const struct task_struct *task,
-//                              enum pid_type type);
-// pid_t get_task_ns_pid(const struct task_struct *task, enum pid_type type);
-
-// pid_t get_pid_nr_ns(struct pid *pid, struct pid_namespace *ns);
-// pid_t get_ns_pid(void);
-
-typedef struct pid_key {
-  __u32 pid; // pid as seen by the userspace (for example, inside its container)
-  __u32 ns;  // pids namespace for the process
-} __attribute__((packed)) pid_key_t;
-
-typedef struct pid_info_t {
-  __u32 host_pid; // pid as seen by the root cgroup (and by BPF)
-  __u32 user_pid; // pid as seen by the userspace (for example, inside its
-                  // container)
-  __u32 ns;       // pids namespace for the process
-} __attribute__((packed)) pid_info;
-
-static __always_inline void ns_pid_ppid(struct task_struct *task, int *pid,
-                                        int *ppid, __u32 *pid_ns_id) {
-  struct upid upid;
-
-  unsigned int level = BPF_CORE_READ(task, nsproxy, pid_ns_for_children, level);
-  struct pid *ns_pid =
-      (struct pid *)BPF_CORE_READ(task, group_leader, thread_pid);
-  bpf_probe_read_kernel(&upid, sizeof(upid), &ns_pid->numbers[level]);
-
-  *pid = upid.nr;
-  unsigned int p_level =
-      BPF_CORE_READ(task, real_parent, nsproxy, pid_ns_for_children, level);
-
-  struct pid *ns_ppid =
-      (struct pid *)BPF_CORE_READ(task, real_parent, group_leader, thread_pid);
-  bpf_probe_read_kernel(&upid, sizeof(upid), &ns_ppid->numbers[p_level]);
-  *ppid = upid.nr;
-
-  struct ns_common ns = BPF_CORE_READ(task, nsproxy, pid_ns_for_children, ns);
-  *pid_ns_id = ns.inum;
-}
-
-// __hidden struct pid *get_task_pid_ptr(const struct task_struct *task,
-//                                       enum pid_type type) {
-//   // Returns the pid pointer of the given task. See get_task_pid_ptr for
-//   // the kernel implementation.
-//   return (type == PIDTYPE_PID) ? BPF_CORE_READ(task, thread_pid)
-//                                : BPF_CORE_READ(task, signal, pids[type]);
-// }
-
-// __hidden struct pid_namespace *get_task_pid_ns(const struct task_struct
-// *task,
-//                                                enum pid_type type) {
-//   struct pid_namespace *ns;
-//   struct pid *p;
-//   int level;
-
-//   // See kernel function task_active_pid_ns in pid.c which calls into
-//   // ns_of_pid. Returns the pid namespace of the given task.
-//   if (!task)
-//     task = (struct task_struct *)bpf_get_current_task();
-
-//   if (!task)
-//     return NULL;
-
-//   p = get_task_pid_ptr(task, type);
-//   if (!p)
-//     return NULL;
-
-//   level = BPF_CORE_READ(p, level);
-//   ns = BPF_CORE_READ(p, numbers[level].ns);
-//   return ns;
-// }
-
-// __hidden pid_t get_pid_nr_ns(struct pid *pid, struct pid_namespace *ns) {
-//   int level, ns_level;
-//   pid_t nr = 0;
-
-//   /* This function implements the kernel equivalent pid_nr_ns in linux/pid.h
-//    */
-//   if (!pid || !ns)
-//     return nr;
-
-//   level = BPF_CORE_READ(pid, level);
-//   ns_level = BPF_CORE_READ(ns, level);
-//   if (ns_level <= level) {
-//     struct upid upid;
-
-//     upid = BPF_CORE_READ(pid, numbers[ns_level]);
-//     if (upid.ns == ns)
-//       nr = upid.nr;
-//   }
-//   return nr;
-// }
-
-// __hidden pid_t get_task_ns_pid(const struct task_struct *task) {
-//   struct pid_namespace *ns;
-//   struct pid *p;
-
-//   if (!task)
-//     task = (struct task_struct *)bpf_get_current_task();
-
-//   ns = get_task_pid_ns(task, PIDTYPE_TGID);
-//   p = get_task_pid_ptr(task, PIDTYPE_PID);
-//   return get_pid_nr_ns(p, ns);
-// }
-
-// __hidden pid_t get_ns_pid(void) { return get_task_ns_pid(NULL); }
\ No newline at end of file
+// Both ends of each connection between an application and the proxy, keyed by
+// their own (local to remote) tuple so the peer is found by swapping it
+struct {
+  __uint(type, BPF_MAP_TYPE_SOCKHASH);
+  __uint(max_entries, MAX_CONNECTIONS * 2);
+  __type(key, struct Tuple);
+  __type(value, __u64);
+} map_sock_hash SEC(".maps");
+
+// Cookie of the application socket keyed by the cookie of the proxy's accepted
+// socket, so the proxy can find the original Socket with SO_COOKIE
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u64);
+  __type(value, __u64);
+} map_proxy_socks SEC(".maps");
+
+// Original destination of the datagrams a UDP socket sends to the relay's
+// port, keyed by socket cookie. For a connected socket it is the connected
+// destination, otherwise it is the first datagram of a flow the relay hasn't
+// set up yet.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u64);
+  __type(value, struct Destination);
+} map_udp_socks SEC(".maps");
+
+// Original destination for the replies sent from a proxy relay port, this is
+// maintained by the proxy
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, __u16);
+  __type(value, struct Destination);
+} map_udp_replies SEC(".maps");
+
+// Port of the relay socket for a flow from an unconnected UDP socket, the
+// datagrams after the first are sent straight to it. This is maintained by the
+// proxy.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_CONNECTIONS);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+  __type(key, struct UDPFlow);
+  __type(value, __u16);
+} map_udp_flows SEC(".maps");
@@ -0,0 +1,171 @@
+package connection
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+// Every proxied connection gets an ID that the internal proxy passes to the
+// remote proxy, so the records written on both sides can be joined. The
+// sampling decision is made from the ID, both proxies agree on it as long as
+// they use the same rate. Connections that fail are always written.
+
+// AccessRecord is one line of the access log
+type AccessRecord struct {
+	Time           time.Time `json:"time"`
+	ID             string    `json:"id"`
+	Listener       string    `json:"listener"`
+	Source         string    `json:"source"`
+	SourcePod      string    `json:"source_pod,omitempty"`
+	Destination    string    `json:"destination"` // the original destination
+	DestinationPod string    `json:"destination_pod,omitempty"`
+	Peer           string    `json:"peer,omitempty"` // identity in the peer proxy's certificate
+	TLSVersion     string    `json:"tls_version,omitempty"`
+	TLSCipher      string    `json:"tls_cipher,omitempty"`
+	BytesSent      int64     `json:"bytes_sent"`     // from the connecting side
+	BytesReceived  int64     `json:"bytes_received"` // towards the connecting side
+	DurationMs     float64   `json:"duration_ms"`
+	Reason         string    `json:"reason"`
+	Status         string    `json:"status,omitempty"` // why the connection was refused
+	Error          string    `json:"error,omitempty"`
+
+	start time.Time
+	stats PipeStats
+}
+
+// Termination reasons that don't come from the pipe
+const (
+	accessRejected = "rejected"
+	accessFailed   = "failed"
+)
+
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	sample float64
+}
+
+// OpenAccessLog opens the access log, "-" is stdout and an empty path leaves it
+// disabled
+func (c *Config) OpenAccessLog() error {
+	if c.AccessLog == "" {
+		return nil
+	}
+	if c.AccessLogSample < 0 || c.AccessLogSample > 1 {
+		return fmt.Errorf("access log sample rate [%v] must be between 0 and 1", c.AccessLogSample)
+	}
+	var w io.Writer = os.Stdout
+	if c.AccessLog != "-" {
+		f, err := os.OpenFile(c.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening access log: %v", err)
+		}
+		w = f
+	}
+	c.accessLog = &accessLog{w: w, sample: c.AccessLogSample}
+	return nil
+}
+
+// newConnectionID returns a random 16 character ID
+func newConnectionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newAccessRecord starts the record for a connection and adds it to the active
+// connections, an empty id creates a new one
+func (c *Config) newAccessRecord(listener, id string, source net.Addr, destination string) *AccessRecord {
+	if id == "" {
+		id = newConnectionID()
+	}
+	r := &AccessRecord{
+		ID:          id,
+		Listener:    listener,
+		Destination: destination,
+		Reason:      accessFailed,
+		start:       time.Now(),
+	}
+	if source != nil {
+		r.Source = source.String()
+	}
+	c.active.add(r)
+	return r
+}
+
+// setTLS records the peer proxy's identity and the TLS parameters
+func (r *AccessRecord) setTLS(state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	r.Peer = peerIdentity(state)
+	r.TLSVersion = tls.VersionName(state.Version)
+	r.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+}
+
+// finish records how the pipe ended
+func (r *AccessRecord) finish(result PipeResult) {
+	r.BytesSent = result.Upstream
+	r.BytesReceived = result.Downstream
+	r.Reason = result.Reason
+	if result.Err != nil {
+		r.Error = result.Err.Error()
+	}
+}
+
+// reject records that the connection was refused
+func (r *AccessRecord) reject(status Status) {
+	r.Reason = accessRejected
+	r.Status = status.String()
+}
+
+// sampled decides from the ID whether a successful connection is written
+func (l *accessLog) sampled(id string) bool {
+	if l.sample >= 1 {
+		return true
+	}
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) < 8 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(b)) < l.sample*math.MaxUint64
+}
+
+// closeAccessRecord removes r from the active connections and writes it to
+// the access log
+func (c *Config) closeAccessRecord(r *AccessRecord) {
+	c.active.remove(r)
+	l := c.accessLog
+	if l == nil {
+		return
+	}
+	if r.Reason == PipeClosed && !l.sampled(r.ID) {
+		return
+	}
+	r.Time = r.start.UTC()
+	r.DurationMs = float64(time.Since(r.start).Microseconds()) / 1000
+	b, err := json.Marshal(r)
+	if err != nil {
+		slog.Printf("Failed to encode access record: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(b)
+	if err != nil {
+		slog.Printf("Failed to write access record: %v", err)
+	}
+}
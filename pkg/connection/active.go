@@ -0,0 +1,65 @@
+package connection
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ActiveConnection is a connection that is being proxied right now
+type ActiveConnection struct {
+	ID            string    `json:"id"`
+	Listener      string    `json:"listener"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	Started       time.Time `json:"started"`
+	Age           string    `json:"age"`
+	BytesSent     int64     `json:"bytes_sent"`     // from the connecting side
+	BytesReceived int64     `json:"bytes_received"` // towards the connecting side
+}
+
+// activeRecords are the records of the connections that haven't finished
+type activeRecords struct {
+	sync.Mutex
+	records map[*AccessRecord]struct{}
+}
+
+func (a *activeRecords) add(r *AccessRecord) {
+	a.Lock()
+	defer a.Unlock()
+	if a.records == nil {
+		a.records = map[*AccessRecord]struct{}{}
+	}
+	a.records[r] = struct{}{}
+}
+
+func (a *activeRecords) remove(r *AccessRecord) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.records, r)
+}
+
+// ActiveConnections returns the connections being proxied, oldest first
+func (c *Config) ActiveConnections() []ActiveConnection {
+	c.active.Lock()
+	defer c.active.Unlock()
+	connections := make([]ActiveConnection, 0, len(c.active.records))
+	for r := range c.active.records {
+		// Only the fields set when the record was created are safe to read
+		upstream, downstream := r.stats.Bytes()
+		connections = append(connections, ActiveConnection{
+			ID:            r.ID,
+			Listener:      r.Listener,
+			Source:        r.Source,
+			Destination:   r.Destination,
+			Started:       r.start.UTC(),
+			Age:           time.Since(r.start).Round(time.Second).String(),
+			BytesSent:     upstream,
+			BytesReceived: downstream,
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Started.Before(connections[j].Started)
+	})
+	return connections
+}
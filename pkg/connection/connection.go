@@ -1,40 +1,153 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/gookit/slog"
+	"golang.org/x/net/http2"
 )
 
+// How long we wait for the remote proxy to send or acknowledge a header
+const handshakeTimeout = 5 * time.Second
+
+// Config is the proxy configuration, the fields that aren't json:"-" are
+// shown by the admin API
 type Config struct {
-	ProxyPort      int
-	ClusterPort    int
-	ClusterTLSPort int
-	Address        string
-	ClusterAddress string // For Debug purposes
-	CgroupOverride string // For Debug purposes
+	ProxyPort       int
+	ClusterPort     int
+	ClusterTLSPort  int
+	Address         string
+	ClusterAddress  string // For Debug purposes
+	CgroupOverride  string // For Debug purposes
+	ForceRootCgroup bool   // Allow attaching to the root cgroup
+	HostCgroup      string // The node's cgroup v2 hierarchy, mounted by the webhook
+	Debug           bool   // Log every eBPF event
+	DebugAddress    string // Address for the debug endpoint
+	MetricsAddress  string // Address for the Prometheus metrics endpoint
+	HealthAddress   string // Address for /healthz and /readyz, the kubelet probes these
+	AdminAddress    string // Address for the admin API
+	PodName         string // The pod we are running in, for the access log
+	PodUID          string // The pod's UID, the pinned eBPF objects are kept per pod UID
+
+	AccessLog       string  // File the per-connection JSON records go to, "-" is stdout and empty disables it
+	AccessLogSample float64 // Fraction of successful connections written to the access log
+
+	PodCIDR             string
+	Certificates        *Certs `json:"-"`
+	RequireCertificates bool   // Don't run without TLS
+
+	Address6 string // IPv6 address of the internal proxy
+	PodCIDR6 string // IPv6 CIDR range for pods, empty disables IPv6 interception
+
+	ExcludeCIDRs string        // CIDRs that are never intercepted
+	CIDRFile     string        // YAML file of include/exclude CIDRs
+	KubeCIDRs    bool          // Intercept the node pod CIDRs and service CIDRs
+	PolicyFile   string        // YAML file of destination policies
+	CIDRRefresh  time.Duration // How often the files and Kubernetes are checked
+
+	ExcludePorts string // Outbound ports that are never intercepted
+	IncludePorts string // Only intercept these outbound ports, empty means all
+
+	Socks      *ebpf.Map `json:"-"` // Original IPv4 sockets by application socket cookie
+	Socks6     *ebpf.Map `json:"-"` // Original IPv6 sockets by application socket cookie
+	ProxySocks *ebpf.Map `json:"-"` // Application socket cookie by proxy socket cookie
+
+	UDPPort    int       // Port for the UDP relay, 0 disables UDP interception
+	ExcludeDNS bool      // Don't intercept UDP to port 53
+	UDPSocks   *ebpf.Map `json:"-"`
+	UDPReplies *ebpf.Map `json:"-"`
+	UDPFlows   *ebpf.Map `json:"-"`
 
-	PodCIDR      string
-	Certificates *Certs
+	Proxy     bool
+	ProxyFunc func(string) string `json:"-"`
 
-	Socks *ebpf.Map
+	Tunnel bool // Multiplex connections to peers over HTTP/2 CONNECT
 
-	Proxy     bool
-	ProxyFunc func(string) string
+	IdleTimeout time.Duration // Close connections with no traffic for this long
+	MaxLifetime time.Duration // Close connections after this long regardless
+
+	// Application ports that expect a PROXY protocol v2 header, 0 means all
+	ProxyProtocolPorts map[uint16]bool
+
+	KTLS bool // Hand the tunnel encryption to the kernel when both sides support it
+
+	Mark int // SO_MARK on the proxy's own sockets, the eBPF doesn't intercept these
+
+	FastPath bool // Move data between the application and the proxy with sockmap
+
+	InboundMode  string // off, permissive or strict
+	InboundPort  int    // Port inbound connections to the application are steered to
+	InboundPorts string // Application ports whose inbound connections are steered
+
+	PinPath        string        // bpffs directory for the pinned maps and links, empty disables pinning
+	Handover       bool          // Take the listening sockets from the running proxy
+	HandoverSocket string        // Unix socket the listening sockets are passed over
+	DrainTimeout   time.Duration // How long to wait for connections after handing over
+
+	// Listening sockets inherited from the previous proxy, keyed by name
+	Inherited map[string]*os.File `json:"-"`
+
+	tls         *tlsConfigs
+	accessLog   *accessLog
+	active      activeRecords
+	listeners   listeners
+	connections sync.WaitGroup
+
+	// Guards the fields that change once the admin API is serving
+	mu sync.RWMutex
+}
+
+// configJSON is Config without its methods, so Snapshot doesn't recurse
+type configJSON Config
+
+// Snapshot encodes the configuration under the lock, the admin API serves it
+// while Start is still filling it in
+func (c *Config) Snapshot() (json.RawMessage, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return json.Marshal((*configJSON)(c))
+}
+
+// LoadedCertificates returns the certificates, which Start loads while the
+// admin API may already be serving
+func (c *Config) LoadedCertificates() *Certs {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Certificates
+}
+
+// Update changes the configuration under the lock Snapshot takes
+func (c *Config) Update(f func(c *Config)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c)
 }
 
 func (c *Config) StartInternalListener() net.Listener {
 	proxyAddr := fmt.Sprintf("%s:%d", c.Address, c.ProxyPort)
-	listener, err := net.Listen("tcp", proxyAddr)
+	listener, err := c.listen(ListenerInternal, "tcp", proxyAddr)
+	if err != nil {
+		slog.Fatalf("Failed to start proxy server: %v", err)
+	}
+	slog.Infof("[pid: %d] %s", os.Getpid(), proxyAddr)
+	return listener
+}
+
+// StartInternalListener6 is the internal proxy for IPv6 connections
+func (c *Config) StartInternalListener6() net.Listener {
+	proxyAddr := net.JoinHostPort(c.Address6, strconv.Itoa(c.ProxyPort))
+	listener, err := c.listen(ListenerInternal6, "tcp6", proxyAddr)
 	if err != nil {
 		slog.Fatalf("Failed to start proxy server: %v", err)
 	}
@@ -42,9 +155,11 @@ func (c *Config) StartInternalListener() net.Listener {
 	return listener
 }
 
+// The external listeners are dual-stack ([::]), remote proxies can connect
+// over IPv4 or IPv6
 func (c *Config) StartExternalListener() net.Listener {
-	proxyAddr := fmt.Sprintf("0.0.0.0:%d", c.ClusterPort)
-	listener, err := net.Listen("tcp", proxyAddr)
+	proxyAddr := fmt.Sprintf(":%d", c.ClusterPort)
+	listener, err := c.listen(ListenerExternal, "tcp", proxyAddr)
 	if err != nil {
 		slog.Fatalf("Failed to start proxy server: %v", err)
 	}
@@ -53,49 +168,39 @@ func (c *Config) StartExternalListener() net.Listener {
 }
 
 func (c *Config) StartExternalTLSListener() net.Listener {
-	proxyAddr := fmt.Sprintf("0.0.0.0:%d", c.ClusterTLSPort)
-
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(c.Certificates.ca) {
-		log.Fatalf("could not append CA")
-	}
-	certificate, err := tls.X509KeyPair(c.Certificates.cert, c.Certificates.key)
+	proxyAddr := fmt.Sprintf(":%d", c.ClusterTLSPort)
 
+	t, err := c.tlsConfigs()
 	if err != nil {
-		log.Fatalf("could not load certificate: %v", err)
+		log.Fatalf("%v", err)
 	}
 
-	config := &tls.Config{
-		ClientCAs:    caCertPool,
-		Certificates: []tls.Certificate{certificate},
-		ClientAuth:   tls.VerifyClientCertIfGiven,
-	} //<-- this is the key
-
-	listener, err := tls.Listen("tcp", proxyAddr, config)
-
-	// listener, err := net.Listen("tcp", proxyAddr)
+	listener, err := c.listen(ListenerTLS, "tcp", proxyAddr)
 	if err != nil {
 		slog.Fatalf("Failed to start proxy server: %v", err)
 	}
 	slog.Infof("[pid: %d] %s", os.Getpid(), proxyAddr)
-	return listener
+	return tls.NewListener(listener, t.server)
 }
 
 // Blocking function
 func (c *Config) StartListeners(listener net.Listener, internal bool) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil && !errors.Is(err, net.ErrClosed) {
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
 			slog.Printf("Failed to accept connection: %v", err)
 			continue
 		} else {
 			if conn != nil {
 				if internal {
 					slog.Printf("internal %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-					go c.internalProxy(conn)
+					c.track(ListenerInternal, func() { c.internalProxy(conn) })
 				} else {
 					slog.Printf("external %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-					go c.handleExternalConnection(conn)
+					c.track(ListenerExternal, func() { c.handleExternalConnection(conn) })
 				}
 			}
 		}
@@ -107,145 +212,317 @@ func (c *Config) StartTLSListener(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			if !errors.Is(err, net.ErrClosed) { // Don't print closing connection error, just continue to the next
-				slog.Printf("Failed to accept connection: %v", err)
+			if errors.Is(err, net.ErrClosed) { // The listener has been closed (or handed over)
+				return
 			}
+			slog.Printf("Failed to accept connection: %v", err)
 			continue
 		}
 
 		slog.Printf(" %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-		go c.handleTLSExternalConnection(conn)
+		c.track(ListenerTLS, func() { c.handleTLSExternalConnection(conn) })
 
 	}
 }
 
-// HTTP proxy request handler
-func (c *Config) internalProxy(conn net.Conn) {
-	defer conn.Close()
-	// Get original destination address
-	destAddr, destPort, err := c.findTargetFromConnection(conn)
+// clientTLSConfig is used by the internal proxy when connecting to the remote
+// proxy, it is shared so it must not be modified
+func (c *Config) clientTLSConfig() (*tls.Config, error) {
+	t, err := c.tlsConfigs()
 	if err != nil {
-		return
+		return nil, err
 	}
-	targetDestination := fmt.Sprintf("%s:%d", destAddr, destPort)
-	var targetConn net.Conn
-	var endpoint string
-	// Send traffic to endpoint gateway
-	if c.Certificates != nil {
-
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(c.Certificates.ca) {
-			log.Fatalf("could not append CA")
-		}
-		certificate, err := tls.X509KeyPair(c.Certificates.cert, c.Certificates.key)
-		if err != nil {
-			log.Fatalf("could not load certificate: %v", err)
-		}
-
-		config := &tls.Config{
-			RootCAs:      caCertPool,
-			Certificates: []tls.Certificate{certificate},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-		} //<-- this is the key
+	return t.client, nil
+}
 
-		endpoint = fmt.Sprintf("%s:%d", destAddr, c.ClusterTLSPort)
+// remoteEndpoint returns the address of the remote proxy for a destination
+func (c *Config) remoteEndpoint(destAddr string) string {
+	if c.Certificates != nil {
+		endpoint := net.JoinHostPort(destAddr, strconv.Itoa(c.ClusterTLSPort))
 		if c.ClusterAddress != "" {
 			endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
 		}
 		if c.Proxy {
 			endpoint = c.ProxyFunc(destAddr)
 		}
+		return endpoint
+	}
+	endpoint := net.JoinHostPort(destAddr, strconv.Itoa(c.ClusterPort))
+	if c.ClusterAddress != "" {
+		endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
+	}
+	return endpoint
+}
 
-		// Set a timeout, mainly because connections can occur to pods that aren't ready
-		d := net.Dialer{Timeout: time.Second * 3}
-		targetConn, err = tls.DialWithDialer(&d, "tcp", endpoint, config)
+// dialRemoteProxy connects to the remote proxy, using mTLS if we have certificates
+func (c *Config) dialRemoteProxy(endpoint string) (net.Conn, error) {
+	start := time.Now()
+	if c.Certificates != nil {
+		config, err := c.clientTLSConfig()
 		if err != nil {
-			slog.Printf("Failed to connect to destination TLS proxy: %v", err)
-			return
-		}
-	} else {
-		endpoint = fmt.Sprintf("%s:%d", destAddr, c.ClusterPort)
-		if c.ClusterAddress != "" {
-			endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
+			return nil, err
 		}
-		// Check that the original destination address is reachable from the proxy
-		targetConn, err = net.DialTimeout("tcp", endpoint, 5*time.Second)
+		conn, err := c.dialTLS(context.Background(), endpoint, config)
 		if err != nil {
-			slog.Printf("Failed to connect to original destination: %v", err)
-			return
+			observeDial(dialRemoteProxyTarget, start, err)
+			return nil, err
 		}
+		observeDial(dialRemoteProxyTarget, start, nil)
+		return conn, nil
 	}
-	defer targetConn.Close()
+	conn, err := c.dial("tcp", endpoint, 5*time.Second)
+	observeDial(dialRemoteProxyTarget, start, err)
+	return conn, err
+}
 
-	slog.Printf("connect to proxy %s, original %s", endpoint, targetDestination)
-	//log.Printf("Internal proxy sending original destination: %s\n", targetDestination)
-	_, err = targetConn.Write([]byte(targetDestination))
+// dialTLS connects to a remote proxy and completes the TLS handshake
+func (c *Config) dialTLS(ctx context.Context, endpoint string, config *tls.Config) (*tls.Conn, error) {
+	// Set a timeout, mainly because connections can occur to pods that aren't ready
+	raw, err := c.dialer(time.Second*3).DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(endpoint)
+		config = config.Clone()
+		config.ServerName = host
+	}
+	conn := tls.Client(raw, config)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = conn.HandshakeContext(ctx)
+	observeHandshake("client", conn, err)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshakeRemoteProxy sends the header and waits until our remote endpoint
+// has connected to the original destination
+func handshakeRemoteProxy(conn net.Conn, header *Header) (*Reply, error) {
+	err := WriteHeader(conn, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send original destination: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	reply, err := ReadReply(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply from remote proxy: %w", err)
+	}
+	return reply, nil
+}
+
+// handshakeLegacyProxy sends the original "ip:port" handshake to an older
+// remote proxy
+func handshakeLegacyProxy(conn net.Conn, header *Header) (*Reply, error) {
+	err := WriteLegacyHeader(conn, header)
 	if err != nil {
-		slog.Printf("Failed to send original destination: %v", err)
+		return nil, fmt.Errorf("failed to send original destination: %w", err)
 	}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	reply, err := ReadLegacyReply(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply from remote proxy: %w", err)
+	}
+	return reply, nil
+}
 
-	tmp := make([]byte, 256)
+// legacyPeers are the remote proxies that only understand the original
+// handshake by endpoint, they are given the binary header again after
+// legacyPeerRetry in case they have been upgraded
+var legacyPeers sync.Map
 
-	// Ideally we wait here until our remote endpoint has recieved the targetDestination
-	targetConn.Read(tmp)
+const legacyPeerRetry = time.Minute
 
-	//log.Printf("Internal connection from %s to %s\n", conn.RemoteAddr(), targetConn.RemoteAddr())
+// handshake sends the header to the remote proxy, falling back to the legacy
+// handshake for older proxies. An older proxy closes the connection when it
+// can't parse the header, so the returned connection replaces conn.
+func (c *Config) handshake(endpoint string, conn net.Conn, header *Header) (net.Conn, *Reply, error) {
+	if since, ok := legacyPeers.Load(endpoint); ok && time.Since(since.(time.Time)) < legacyPeerRetry {
+		reply, err := handshakeLegacyProxy(conn, header)
+		return conn, reply, err
+	}
+	reply, err := handshakeRemoteProxy(conn, header)
+	if !errors.Is(err, ErrLegacyPeer) {
+		if err == nil {
+			legacyPeers.Delete(endpoint)
+		}
+		return conn, reply, err
+	}
+	slog.Printf("%s is an older proxy, using the legacy handshake", endpoint)
+	legacyPeers.Store(endpoint, time.Now())
+	conn.Close()
+	legacyConn, err := c.dialRemoteProxy(endpoint)
+	if err != nil {
+		return conn, nil, err
+	}
+	reply, err = handshakeLegacyProxy(legacyConn, header)
+	return legacyConn, reply, err
+}
+
+// HTTP proxy request handler
+func (c *Config) internalProxy(conn net.Conn) {
+	defer conn.Close()
+	// Get original destination address
+	destAddr, destPort, err := c.findTargetFromConnection(conn)
+	if err != nil {
+		return
+	}
+	targetDestination := net.JoinHostPort(destAddr, strconv.Itoa(int(destPort)))
+	endpoint := c.remoteEndpoint(destAddr)
+	record := c.newAccessRecord(ListenerInternal, "", conn.RemoteAddr(), targetDestination)
+	record.SourcePod = c.PodName
+	defer c.closeAccessRecord(record)
+
+	// Carry the connection as a stream over the shared tunnel to the peer
+	if c.Certificates != nil && c.Tunnel {
+		c.tunnelProxy(conn, endpoint, record)
+		return
+	}
+
+	targetConn, err := c.dialRemoteProxy(endpoint)
+	if err != nil {
+		slog.Printf("Failed to connect to remote proxy %s: %v", endpoint, err)
+		rejectConnection(conn, record, StatusFromError(err))
+		return
+	}
+	// targetConn is replaced by the raw socket if we switch to kTLS
+	defer func() { targetConn.Close() }()
+	peer := connPeer(targetConn)
+	if tlsConn, ok := targetConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		record.setTLS(&state)
+	}
+
+	slog.Printf("connect to proxy %s, original %s", endpoint, targetDestination)
+	header, err := NewHeader(destAddr, destPort)
+	if err != nil {
+		slog.Printf("Failed to create header for original destination: %v", err)
+		rejectConnection(conn, record, StatusFailure)
+		return
+	}
+	if source, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		header.SetSourcePort(uint16(source.Port))
+	}
+	header.SetValue(TLVConnection, record.ID)
+	header.SetValue(TLVSourcePod, c.PodName)
+	ktls := c.requestKTLS(targetConn, header)
+	var reply *Reply
+	targetConn, reply, err = c.handshake(endpoint, targetConn, header)
+	if err != nil {
+		slog.Print(err)
+		rejectConnection(conn, record, StatusFromError(err))
+		return
+	}
+	if reply.Status != StatusOK {
+		// Pass the remote failure back to the application
+		rejectConnection(conn, record, reply.Status)
+		return
+	}
 
-	// The following code creates two data transfer channels:
-	// - From the client to the target server (handled by a separate goroutine).
-	// - From the target server to the client (handled by the main goroutine).
-	go func() {
-		_, err = io.Copy(targetConn, conn)
+	// The remote proxy has agreed to kTLS, from here the kernel does the encryption
+	if ktls && reply.Flags&ReplyFlagKTLS != 0 {
+		raw, err := switchClientKTLS(targetConn.(*tls.Conn))
 		if err != nil {
-			slog.Printf("Failed copying data to target: %v", err)
+			slog.Printf("Failed to switch to kTLS: %v", err)
+			rejectConnection(conn, record, StatusFailure)
+			return
 		}
-	}()
-	_, err = io.Copy(conn, targetConn)
+		targetConn = raw
+	}
+
+	//log.Printf("Internal connection from %s to %s\n", conn.RemoteAddr(), targetConn.RemoteAddr())
+
+	// Copy data in both directions until both sides are finished
+	opts := c.pipeOptions(record)
+	opts.NoSplice = c.FastPath
+	result := Pipe(conn, targetConn, opts)
+	observePipe(ListenerInternal, peer, result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", conn.RemoteAddr(), targetDestination, result.Reason, result.Upstream, result.Downstream)
+}
+
+// isProxyAddress is true for the internal proxy's own addresses, a peer asking
+// for one of them would loop back through us
+func (c *Config) isProxyAddress(address string) bool {
+	port := strconv.Itoa(c.ProxyPort)
+	if address == net.JoinHostPort(c.Address, port) {
+		return true
+	}
+	return c.PodCIDR6 != "" && address == net.JoinHostPort(c.Address6, port)
+}
+
+// readHeader reads the original destination from the remote internal proxy
+func (c *Config) readHeader(conn net.Conn) (*Header, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	header, err := ReadHeader(conn)
 	if err != nil {
-		slog.Printf("Failed copying data from target: %v", err)
+		return nil, fmt.Errorf("failed to read header from %s: %v", conn.RemoteAddr(), err)
 	}
+	if c.isProxyAddress(header.Address()) {
+		WriteReply(conn, header, StatusLoopDetected)
+		return nil, fmt.Errorf("potential loopback from %s", conn.RemoteAddr())
+	}
+	return header, nil
 }
 
 // Unencrypted external connection
 func (c *Config) handleExternalConnection(conn net.Conn) {
 	defer conn.Close()
 
-	tmp := make([]byte, 256)
-	n, err := conn.Read(tmp)
+	header, err := c.readHeader(conn)
 	if err != nil {
 		slog.Print(err)
+		return
 	}
-	remoteAddress := string(tmp[:n])
-
-	if remoteAddress == fmt.Sprintf("%s:%d", c.Address, c.ProxyPort) {
-		slog.Printf("Potential loopback")
+	if _, udp := header.Lookup(TLVDatagram); udp {
+		c.handleUDPRelay(conn, header)
 		return
 	}
+	remoteAddress := header.Address()
+	source := sourceAddress(conn.RemoteAddr().String(), header.SourcePort())
+	record := c.newAccessRecord(ListenerExternal, header.Value(TLVConnection), source, remoteAddress)
+	record.SourcePod = header.Value(TLVSourcePod)
+	record.DestinationPod = c.PodName
+	defer c.closeAccessRecord(record)
 
 	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", remoteAddress, 5*time.Second)
+	start := time.Now()
+	targetConn, err := c.dial("tcp", remoteAddress, 5*time.Second)
+	observeDial(dialApplicationTarget, start, err)
 	if err != nil {
-		slog.Printf("Failed to connect to original destination[%s]: %v", string(tmp), err)
+		slog.Printf("Failed to connect to original destination[%s]: %v", remoteAddress, err)
+		// Tell the remote proxy why, so it can tell the application
+		record.reject(StatusFromError(err))
+		WriteReply(conn, header, StatusFromError(err))
 		return
 	}
 	defer targetConn.Close()
-	conn.Write([]byte{'Y'}) // Send a response to kickstart the comms
+	err = c.sendProxyProtocol(targetConn, source, targetConn.RemoteAddr().(*net.TCPAddr), nil)
+	if err != nil {
+		slog.Printf("Failed to send proxy protocol header to [%s]: %v", remoteAddress, err)
+		record.reject(StatusFailure)
+		WriteReply(conn, header, StatusFailure)
+		return
+	}
+	err = WriteReply(conn, header, StatusOK) // Send a response to kickstart the comms
+	if err != nil {
+		slog.Printf("Failed to send reply: %v", err)
+		return
+	}
 
 	slog.Printf("%s -> %s", conn.RemoteAddr(), targetConn.RemoteAddr())
 
-	// The following code creates two data transfer channels:
-	// - From the client to the target server (handled by a separate goroutine).
-	// - From the target server to the client (handled by the main goroutine).
-	go func() {
-		_, err = io.Copy(targetConn, conn)
-		if err != nil {
-			slog.Printf("Failed copying data to target: %v", err)
-		}
-	}()
-	_, err = io.Copy(conn, targetConn)
-	if err != nil {
-		slog.Printf("Failed copying data from target: %v", err)
-	}
+	// Copy data in both directions until both sides are finished
+	result := Pipe(conn, targetConn, c.pipeOptions(record))
+	observePipe(ListenerExternal, unknownPeer, result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", conn.RemoteAddr(), remoteAddress, result.Reason, result.Upstream, result.Downstream)
 }
 
 // Unencrypted external connection
@@ -253,42 +530,81 @@ func (c *Config) handleTLSExternalConnection(conn net.Conn) {
 	defer conn.Close()
 	var tConn *tls.Conn = conn.(*tls.Conn)
 
-	tmp := make([]byte, 256)
-	n, err := tConn.Read(tmp)
+	tConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tConn.Handshake()
+	observeHandshake("server", tConn, err)
 	if err != nil {
-		slog.Print(err)
+		slog.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	tConn.SetDeadline(time.Time{})
+	state := tConn.ConnectionState()
+	peer := peerLabel(&state)
+	// Peers in tunnel mode will multiplex their connections over HTTP/2
+	if state.NegotiatedProtocol == http2.NextProtoTLS {
+		c.serveTunnel(tConn)
+		return
 	}
 
-	remoteAddress := string(tmp[:n])
-
-	if remoteAddress == fmt.Sprintf("%s:%d", c.Address, c.ProxyPort) {
-		slog.Printf("Potential loopback")
+	header, err := c.readHeader(tConn)
+	if err != nil {
+		slog.Print(err)
+		return
+	}
+	if _, udp := header.Lookup(TLVDatagram); udp {
+		c.handleUDPRelay(tConn, header)
 		return
 	}
+	remoteAddress := header.Address()
+	source := sourceAddress(conn.RemoteAddr().String(), header.SourcePort())
+	record := c.newAccessRecord(ListenerTLS, header.Value(TLVConnection), source, remoteAddress)
+	record.SourcePod = header.Value(TLVSourcePod)
+	record.DestinationPod = c.PodName
+	record.setTLS(&state)
+	defer c.closeAccessRecord(record)
 
 	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", remoteAddress, 5*time.Second)
+	start := time.Now()
+	targetConn, err := c.dial("tcp", remoteAddress, 5*time.Second)
+	observeDial(dialApplicationTarget, start, err)
 	//targetConn, err := tls.Dial("tcp", remoteAddress, config)
 	if err != nil {
-		slog.Printf("Failed to connect to original destination[%s]: %v", string(tmp), err)
+		slog.Printf("Failed to connect to original destination[%s]: %v", remoteAddress, err)
+		// Tell the remote proxy why, so it can tell the application
+		record.reject(StatusFromError(err))
+		WriteReply(tConn, header, StatusFromError(err))
 		return
 	}
 	defer targetConn.Close()
-	tConn.Write([]byte{'Y'}) // Send a response to kickstart the comms
-
-	slog.Printf("%s -> %s", conn.RemoteAddr(), targetConn.RemoteAddr())
-
-	// The following code creates two data transfer channels:
-	// - From the client to the target server (handled by a separate goroutine).
-	// - From the target server to the client (handled by the main goroutine).
-	go func() {
-		_, err = io.Copy(targetConn, tConn)
+	err = c.sendProxyProtocol(targetConn, source, targetConn.RemoteAddr().(*net.TCPAddr), &state)
+	if err != nil {
+		slog.Printf("Failed to send proxy protocol header to [%s]: %v", remoteAddress, err)
+		record.reject(StatusFailure)
+		WriteReply(tConn, header, StatusFailure)
+		return
+	}
+	// Switch to kTLS if the internal proxy asked for it and our kernel can do it
+	var peerConn net.Conn = tConn
+	_, ktls := header.Lookup(TLVKTLS)
+	if ktls && ktlsSupported() == nil && enableKTLS(tConn.NetConn()) == nil {
+		peerConn, err = switchServerKTLS(tConn, header)
 		if err != nil {
-			slog.Printf("Failed copying data to target: %v", err)
+			slog.Printf("Failed to switch to kTLS: %v", err)
+			return
+		}
+	} else {
+		err = WriteReply(tConn, header, StatusOK) // Send a response to kickstart the comms
+		if err != nil {
+			slog.Printf("Failed to send reply: %v", err)
+			return
 		}
-	}()
-	_, err = io.Copy(tConn, targetConn)
-	if err != nil {
-		slog.Printf("Failed copying data from target: %v", err)
 	}
+
+	slog.Printf("%s -> %s", conn.RemoteAddr(), targetConn.RemoteAddr())
+
+	// Copy data in both directions until both sides are finished
+	result := Pipe(peerConn, targetConn, c.pipeOptions(record))
+	observePipe(ListenerTLS, peer, result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", conn.RemoteAddr(), remoteAddress, result.Reason, result.Upstream, result.Downstream)
 }
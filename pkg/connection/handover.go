@@ -0,0 +1,142 @@
+package connection
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// During an upgrade the running proxy hands its listening sockets to the new
+// one, so connections are never refused, and then waits for its own
+// connections to finish. The sockets are passed as files, keyed by name.
+
+// Names of the listening sockets
+const (
+	ListenerInternal  = "internal"
+	ListenerInternal6 = "internal6"
+	ListenerExternal  = "external"
+	ListenerTLS       = "tls"
+	ListenerUDP       = "udp"
+	ListenerInbound   = "inbound"
+)
+
+type fileListener interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// listeners are the sockets this proxy is listening on
+type listeners struct {
+	sync.Mutex
+	sockets map[string]fileListener
+}
+
+// trackListener remembers a listening socket so that it can be handed over
+func (c *Config) trackListener(name string, l fileListener) {
+	c.listeners.Lock()
+	defer c.listeners.Unlock()
+	if c.listeners.sockets == nil {
+		c.listeners.sockets = map[string]fileListener{}
+	}
+	c.listeners.sockets[name] = l
+}
+
+// listen returns the inherited listener for name or creates a new one
+func (c *Config) listen(name, network, address string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if f, ok := c.Inherited[name]; ok {
+		listener, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("using inherited %s listener: %v", name, err)
+		}
+	} else {
+		listener, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.trackListener(name, listener.(*net.TCPListener))
+	return listener, nil
+}
+
+// listenUDP returns the inherited UDP socket for name or creates a new one
+func (c *Config) listenUDP(name string, address *net.UDPAddr) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if f, ok := c.Inherited[name]; ok {
+		packetConn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("using inherited %s socket: %v", name, err)
+		}
+		conn = packetConn.(*net.UDPConn)
+	} else {
+		var err error
+		conn, err = c.listenUDPMarked(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.trackListener(name, conn)
+	return conn, nil
+}
+
+// ListenerFiles duplicates the listening sockets so they can be passed to
+// another process
+func (c *Config) ListenerFiles() (map[string]*os.File, error) {
+	c.listeners.Lock()
+	defer c.listeners.Unlock()
+	files := map[string]*os.File{}
+	for name, l := range c.listeners.sockets {
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("duplicating %s listener: %v", name, err)
+		}
+		files[name] = f
+	}
+	return files, nil
+}
+
+// CloseListeners stops accepting new connections
+func (c *Config) CloseListeners() {
+	c.listeners.Lock()
+	defer c.listeners.Unlock()
+	for _, l := range c.listeners.sockets {
+		l.Close()
+	}
+}
+
+// Drain waits for the proxied connections to finish, it returns false if the
+// timeout was reached first
+func (c *Config) Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		c.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// track runs a connection handler for a listener so that Drain can wait for it
+func (c *Config) track(listener string, handler func()) {
+	c.connections.Add(1)
+	acceptedConnections.WithLabelValues(listener).Inc()
+	active := activeConnections.WithLabelValues(listener)
+	active.Inc()
+	go func() {
+		defer c.connections.Done()
+		defer active.Dec()
+		handler()
+	}()
+}
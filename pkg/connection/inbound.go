@@ -0,0 +1,106 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+// Inbound connections to the application ports are steered by the eBPF to the
+// inbound listener. Peers going through their own proxy arrive on the
+// ClusterTLSPort instead, so anything reaching the inbound listener has skipped
+// the mesh. In PERMISSIVE mode it is passed on to the application over
+// loopback, in STRICT mode it is refused (as is anything without a client
+// certificate).
+
+// Inbound modes
+const (
+	InboundOff        = "off"
+	InboundPermissive = "permissive"
+	InboundStrict     = "strict"
+)
+
+// ParseInboundMode checks the mode, an empty mode is off
+func ParseInboundMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return InboundOff, nil
+	case InboundOff, InboundPermissive, InboundStrict:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown inbound mode [%s], expected off, permissive or strict", mode)
+}
+
+// StartInboundListener is where the eBPF sends inbound connections, it listens
+// on all addresses as the connections keep their original destination
+func (c *Config) StartInboundListener() net.Listener {
+	proxyAddr := fmt.Sprintf(":%d", c.InboundPort)
+	listener, err := c.listen(ListenerInbound, "tcp", proxyAddr)
+	if err != nil {
+		slog.Fatalf("Failed to start proxy server: %v", err)
+	}
+	slog.Infof("[pid: %d] %s (inbound %s)", os.Getpid(), proxyAddr, c.InboundMode)
+	return listener
+}
+
+// Blocking function
+func (c *Config) StartInboundListeners(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { // The listener has been closed (or handed over)
+				return
+			}
+			slog.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+		slog.Printf("inbound %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		c.track(ListenerInbound, func() { c.handleInboundConnection(conn) })
+	}
+}
+
+// handleInboundConnection is a connection that bypassed the peer's proxy
+func (c *Config) handleInboundConnection(conn net.Conn) {
+	defer conn.Close()
+	destination := conn.LocalAddr().(*net.TCPAddr)
+	record := c.newAccessRecord(ListenerInbound, "", conn.RemoteAddr(), destination.String())
+	record.DestinationPod = c.PodName
+	defer c.closeAccessRecord(record)
+	if c.InboundMode != InboundPermissive {
+		rejectConnection(conn, record, StatusPolicyDenied)
+		return
+	}
+
+	// The eBPF ignores loopback, so this reaches the application
+	loopback := "127.0.0.1"
+	if destination.IP.To4() == nil {
+		loopback = "::1"
+	}
+	target := net.JoinHostPort(loopback, strconv.Itoa(destination.Port))
+	start := time.Now()
+	targetConn, err := c.dial("tcp", target, 5*time.Second)
+	observeDial(dialApplicationTarget, start, err)
+	if err != nil {
+		slog.Printf("Failed to connect to application[%s]: %v", target, err)
+		return
+	}
+	defer targetConn.Close()
+	source := conn.RemoteAddr().(*net.TCPAddr)
+	err = c.sendProxyProtocol(targetConn, source, destination, nil)
+	if err != nil {
+		slog.Printf("Failed to send proxy protocol header to [%s]: %v", target, err)
+		return
+	}
+
+	result := Pipe(conn, targetConn, c.pipeOptions(record))
+	observePipe(ListenerInbound, unknownPeer, result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", conn.RemoteAddr(), destination, result.Reason, result.Upstream, result.Downstream)
+}
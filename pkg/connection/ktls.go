@@ -0,0 +1,275 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Kernel TLS (kTLS) moves the record encryption into the kernel once the Go
+// handshake has finished, so the tunnel socket becomes a plain TCP socket that
+// splice() can move data to and from without copying it into userspace.
+//
+// Go doesn't expose the traffic secrets or record sequence numbers of a
+// tls.Conn, so instead both proxies derive fresh keys from the TLS exporter
+// (RFC 8446 section 7.5) and switch over at a well defined point:
+//
+//  1. The internal proxy attaches the "tls" ULP and sends TLVKTLS in the header
+//  2. The remote proxy attaches the ULP, installs its RX key, replies with
+//     ReplyFlagKTLS (still encrypted by Go) and then installs its TX key
+//  3. The internal proxy reads the reply, installs both keys and sends a single
+//     ack byte through the kernel
+//  4. The remote proxy reads the ack before sending any data of its own, which
+//     guarantees the internal proxy has nothing buffered inside the tls.Conn
+//
+// Each proxy probes once that its kernel can install both a TX and an RX key
+// before it requests or agrees to kTLS. If either kernel can't then nothing is
+// requested or agreed and the connection carries on through crypto/tls.
+
+const (
+	solTLS = 282 // SOL_TLS
+	tlsTX  = 1   // TLS_TX
+	tlsRX  = 2   // TLS_RX
+
+	tls13Version       = 0x0304 // TLS_1_3_VERSION
+	tlsCipherAESGCM128 = 51     // TLS_CIPHER_AES_GCM_128
+
+	ktlsExporterLabel = "EXPORTER-smesh-ktls"
+	ktlsAck           = 'K'
+)
+
+// ktlsCryptoInfo matches struct tls12_crypto_info_aes_gcm_128
+type ktlsCryptoInfo struct {
+	Version    uint16
+	CipherType uint16
+	IV         [8]byte
+	Key        [16]byte
+	Salt       [4]byte
+	RecSeq     [8]byte
+}
+
+// ktlsKeyLength is the key, salt and iv for a single direction
+const ktlsKeyLength = 16 + 4 + 8
+
+// ktlsKeys derives the TX and RX keys for this side of the connection
+func ktlsKeys(conn *tls.Conn, client bool) (tx, rx *ktlsCryptoInfo, err error) {
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(ktlsExporterLabel, nil, 2*ktlsKeyLength)
+	if err != nil {
+		return nil, nil, fmt.Errorf("exporting keying material: %v", err)
+	}
+	clientKeys := newKTLSCryptoInfo(material[:ktlsKeyLength])
+	serverKeys := newKTLSCryptoInfo(material[ktlsKeyLength:])
+	if client {
+		return clientKeys, serverKeys, nil
+	}
+	return serverKeys, clientKeys, nil
+}
+
+func newKTLSCryptoInfo(material []byte) *ktlsCryptoInfo {
+	info := &ktlsCryptoInfo{
+		Version:    tls13Version,
+		CipherType: tlsCipherAESGCM128,
+	}
+	copy(info.Key[:], material[:16])
+	copy(info.Salt[:], material[16:20])
+	copy(info.IV[:], material[20:28])
+	return info
+}
+
+// enableKTLS attaches the tls ULP to the connection, this doesn't change the
+// data path until keys are installed so it is safe to try on every connection
+func enableKTLS(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("kTLS requires a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_TCP, unix.TCP_ULP, "tls")
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("attaching tls ULP: %v", sockErr)
+	}
+	return nil
+}
+
+// setKTLSKey installs a key for one direction of the connection
+func setKTLSKey(conn *net.TCPConn, direction int, info *ktlsCryptoInfo) error {
+	var b bytes.Buffer
+	binary.Write(&b, binary.NativeEndian, info)
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptString(int(fd), solTLS, direction, b.String())
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("installing kTLS key: %v", sockErr)
+	}
+	return nil
+}
+
+var ktlsProbe struct {
+	sync.Once
+	err error
+}
+
+// ktlsSupported checks once that the kernel can encrypt and decrypt records,
+// attaching the ULP isn't enough as TLS_TX and TLS_RX came in different
+// kernels and either can be missing from the tls module
+func ktlsSupported() error {
+	ktlsProbe.Do(func() {
+		ktlsProbe.err = probeKTLS()
+		if ktlsProbe.err != nil {
+			slog.Printf("kTLS unavailable, using userspace TLS: %v", ktlsProbe.err)
+		}
+	})
+	return ktlsProbe.err
+}
+
+// probeKTLS sends a record through a loopback connection with a TX key on one
+// end and an RX key on the other
+func probeKTLS() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	material := make([]byte, ktlsKeyLength)
+	for i := range material {
+		material[i] = byte(i + 1)
+	}
+	if err = enableKTLS(client); err != nil {
+		return err
+	}
+	if err = enableKTLS(server); err != nil {
+		return err
+	}
+	if err = setKTLSKey(client.(*net.TCPConn), tlsTX, newKTLSCryptoInfo(material)); err != nil {
+		return err
+	}
+	if err = setKTLSKey(server.(*net.TCPConn), tlsRX, newKTLSCryptoInfo(material)); err != nil {
+		return err
+	}
+	if _, err = client.Write([]byte{ktlsAck}); err != nil {
+		return fmt.Errorf("writing kTLS probe: %v", err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1)
+	if _, err = server.Read(b); err != nil {
+		return fmt.Errorf("reading kTLS probe: %v", err)
+	}
+	if b[0] != ktlsAck {
+		return fmt.Errorf("kTLS probe was corrupted [%x]", b[0])
+	}
+	return nil
+}
+
+// switchClientKTLS is the internal proxy side (step 3), the returned
+// connection must be used instead of the tls.Conn from now on
+func switchClientKTLS(conn *tls.Conn) (*net.TCPConn, error) {
+	raw := conn.NetConn().(*net.TCPConn)
+	tx, rx, err := ktlsKeys(conn, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = setKTLSKey(raw, tlsTX, tx); err != nil {
+		return nil, err
+	}
+	if err = setKTLSKey(raw, tlsRX, rx); err != nil {
+		return nil, err
+	}
+	if _, err = raw.Write([]byte{ktlsAck}); err != nil {
+		return nil, fmt.Errorf("sending kTLS ack: %v", err)
+	}
+	return raw, nil
+}
+
+// switchServerKTLS is the remote proxy side (step 2 and 4), it writes the reply
+// and the returned connection must be used instead of the tls.Conn from now on.
+// Until the reply is sent we can still decline, so a failure to derive or
+// install the RX key leaves the connection in userspace.
+func switchServerKTLS(conn *tls.Conn, header *Header) (net.Conn, error) {
+	raw := conn.NetConn().(*net.TCPConn)
+	tx, rx, err := ktlsKeys(conn, false)
+	if err == nil {
+		err = setKTLSKey(raw, tlsRX, rx)
+	}
+	if err != nil {
+		slog.Printf("Declining kTLS, using userspace TLS: %v", err)
+		if err = WriteReply(conn, header, StatusOK); err != nil {
+			return nil, fmt.Errorf("sending reply: %v", err)
+		}
+		return conn, nil
+	}
+	if err = WriteReplyFlags(conn, header, StatusOK, ReplyFlagKTLS); err != nil {
+		return nil, fmt.Errorf("sending reply: %v", err)
+	}
+	if err = setKTLSKey(raw, tlsTX, tx); err != nil {
+		return nil, err
+	}
+
+	raw.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer raw.SetReadDeadline(time.Time{})
+	ack := make([]byte, 1)
+	if _, err = raw.Read(ack); err != nil {
+		return nil, fmt.Errorf("reading kTLS ack: %v", err)
+	}
+	if ack[0] != ktlsAck {
+		return nil, fmt.Errorf("invalid kTLS ack [%x]", ack[0])
+	}
+	return raw, nil
+}
+
+// requestKTLS tries to prepare an outgoing connection for kTLS, if the kernel
+// can't do it then we quietly carry on in userspace
+func (c *Config) requestKTLS(conn net.Conn, header *Header) bool {
+	if !c.KTLS {
+		return false
+	}
+	tConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	if ktlsSupported() != nil {
+		return false
+	}
+	err := enableKTLS(tConn.NetConn())
+	if err != nil {
+		slog.Debugf("kTLS unavailable, falling back to userspace TLS: %v", err)
+		return false
+	}
+	header.Metadata = append(header.Metadata, TLV{Type: TLVKTLS})
+	return true
+}
@@ -0,0 +1,55 @@
+package connection
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The eBPF leaves sockets carrying Mark alone, so every socket the proxy
+// connects or sends from is marked. Otherwise the proxy would intercept its
+// own connections in a loop.
+
+// markSocket sets SO_MARK on a socket before it is bound or connected
+func (c *Config) markSocket(network, address string, raw syscall.RawConn) error {
+	if c.Mark == 0 {
+		return nil
+	}
+	var err error
+	controlErr := raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, c.Mark)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// dialer returns a dialer for marked sockets
+func (c *Config) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: c.markSocket}
+}
+
+// dial connects a marked socket
+func (c *Config) dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	return c.dialer(timeout).Dial(network, address)
+}
+
+// listenUDPMarked binds a marked UDP socket
+func (c *Config) listenUDPMarked(address *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: c.markSocket}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// DialContext connects a marked socket, for clients (like the Kubernetes one)
+// that take a dial function
+func (c *Config) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.dialer(0).DialContext(ctx, network, address)
+}
@@ -0,0 +1,139 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics for the proxied connections. Peers are labelled with the
+// namespace and service account from the SPIFFE ID in their certificate, and
+// "unknown" otherwise, as the other SANs name a single pod and every restart
+// would start new series.
+
+const unknownPeer = "unknown"
+
+// Dial targets
+const (
+	dialRemoteProxyTarget = "remote_proxy"
+	dialApplicationTarget = "application"
+)
+
+var (
+	acceptedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smesh_connections_accepted_total",
+		Help: "Connections accepted by each listener.",
+	}, []string{"listener"})
+
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smesh_connections_active",
+		Help: "Connections currently being proxied by each listener.",
+	}, []string{"listener"})
+
+	tlsHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smesh_tls_handshakes_total",
+		Help: "TLS handshakes with peer proxies by side (client or server), result and failure reason.",
+	}, []string{"side", "result", "reason", "peer"})
+
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smesh_dial_duration_seconds",
+		Help:    "Time taken to connect to the remote proxy or the local application.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"target", "result"})
+
+	proxiedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smesh_bytes_total",
+		Help: "Bytes proxied, upstream is from the connecting side and downstream is towards it.",
+	}, []string{"listener", "direction", "peer"})
+
+	rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smesh_rejections_total",
+		Help: "Connections refused to the local application by reason.",
+	}, []string{"status"})
+)
+
+func init() {
+	prometheus.MustRegister(acceptedConnections, activeConnections, tlsHandshakes, dialDuration, proxiedBytes, rejectedConnections)
+}
+
+// peerLabel is the namespace/serviceaccount of a verified peer for the metric
+// labels, taken from a spiffe://<trust domain>/ns/<namespace>/sa/<account> SAN
+func peerLabel(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return unknownPeer
+	}
+	for _, u := range state.VerifiedChains[0][0].URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) == 4 && parts[0] == "ns" && parts[2] == "sa" && parts[1] != "" && parts[3] != "" {
+			return parts[1] + "/" + parts[3]
+		}
+	}
+	return unknownPeer
+}
+
+// connPeer is the identity of the peer on a (possibly TLS) connection
+func connPeer(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return peerLabel(&state)
+	}
+	return unknownPeer
+}
+
+// handshakeReason gives a short reason for a failed handshake
+func handshakeReason(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var alert tls.AlertError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown authority"
+	case errors.As(err, &hostname):
+		return "hostname mismatch"
+	case errors.As(err, &invalid):
+		return "invalid certificate"
+	case errors.As(err, &alert):
+		return alert.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return "connection closed"
+	}
+	return "other"
+}
+
+// observeHandshake records a TLS handshake, side is client or server
+func observeHandshake(side string, conn *tls.Conn, err error) {
+	if err != nil {
+		tlsHandshakes.WithLabelValues(side, "failure", handshakeReason(err), unknownPeer).Inc()
+		return
+	}
+	tlsHandshakes.WithLabelValues(side, "success", "", connPeer(conn)).Inc()
+}
+
+// observeDial records how long a dial took
+func observeDial(target string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	dialDuration.WithLabelValues(target, result).Observe(time.Since(start).Seconds())
+}
+
+// observePipe records the bytes moved by a finished pipe
+func observePipe(listener, peer string, result PipeResult) {
+	proxiedBytes.WithLabelValues(listener, "upstream", peer).Add(float64(result.Upstream))
+	proxiedBytes.WithLabelValues(listener, "downstream", peer).Add(float64(result.Downstream))
+}
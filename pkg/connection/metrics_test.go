@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"testing"
+)
+
+func TestPeerLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		uris []string
+		want string
+	}{
+		{name: "no uri sans", want: unknownPeer},
+		{name: "spiffe id", uris: []string{"spiffe://cluster.local/ns/default/sa/client"}, want: "default/client"},
+		{name: "other scheme first", uris: []string{"https://example.com", "spiffe://td/ns/web/sa/frontend"}, want: "web/frontend"},
+		{name: "not a workload id", uris: []string{"spiffe://cluster.local/ns/default"}, want: unknownPeer},
+		{name: "empty account", uris: []string{"spiffe://cluster.local/ns/default/sa/"}, want: unknownPeer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &x509.Certificate{DNSNames: []string{"pod-1234"}}
+			for _, uri := range tt.uris {
+				u, err := url.Parse(uri)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cert.URIs = append(cert.URIs, u)
+			}
+			state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			if got := peerLabel(state); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := peerLabel(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}); got != unknownPeer {
+		t.Errorf("an unverified peer got %q", got)
+	}
+	if got := peerLabel(nil); got != unknownPeer {
+		t.Errorf("no TLS got %q", got)
+	}
+}
@@ -0,0 +1,294 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Reasons a pipe finished
+const (
+	PipeClosed      = "closed"
+	PipeError       = "error"
+	PipeIdleTimeout = "idle timeout"
+	PipeMaxLifetime = "max lifetime"
+)
+
+// PipeOptions control how long a pipe is allowed to live, zero disables the
+// timeout
+type PipeOptions struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// The client is in the eBPF fast path, splice() can't see the data the
+	// eBPF puts on its receive queue
+	NoSplice bool
+	// Stats is updated while the pipe is running, it can be nil
+	Stats *PipeStats
+}
+
+// PipeStats are the bytes a running pipe has copied so far
+type PipeStats struct {
+	upstream   atomic.Int64
+	downstream atomic.Int64
+	// Spliced data never reaches us, so the kernel is asked instead
+	spliced atomic.Pointer[net.TCPConn]
+}
+
+// Bytes returns the bytes copied from the client and to the client so far
+func (s *PipeStats) Bytes() (upstream, downstream int64) {
+	client := s.spliced.Load()
+	if client == nil {
+		return s.upstream.Load(), s.downstream.Load()
+	}
+	rawConn, err := client.SyscallConn()
+	if err != nil {
+		return 0, 0
+	}
+	var info *unix.TCPInfo
+	rawConn.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info == nil {
+		return 0, 0
+	}
+	return int64(info.Bytes_received), int64(info.Bytes_acked)
+}
+
+// PipeResult describes a finished pipe, Upstream is the number of bytes copied
+// from the client to the target and Downstream is the reverse
+type PipeResult struct {
+	Upstream   int64
+	Downstream int64
+	Duration   time.Duration
+	Reason     string
+	Err        error
+}
+
+// halfCloser is implemented by *net.TCPConn, *tls.Conn and our tunnel streams
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// pipeOptions returns the pipe options from the configuration, the progress
+// is kept in the connection's record
+func (c *Config) pipeOptions(record *AccessRecord) PipeOptions {
+	return PipeOptions{
+		IdleTimeout: c.IdleTimeout,
+		MaxLifetime: c.MaxLifetime,
+		Stats:       &record.stats,
+	}
+}
+
+// Pipe copies data in both directions between client and target until both
+// sides have finished. When one direction reaches EOF the write side of the
+// other connection is closed (sending a FIN) so half-closed connections keep
+// working, if that connection can't be half-closed then everything is closed.
+// This is a blocking function.
+func Pipe(client, target io.ReadWriteCloser, opts PipeOptions) PipeResult {
+	p := &pipe{
+		client:   client,
+		target:   target,
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stats:    opts.Stats,
+	}
+	if p.stats == nil {
+		p.stats = &PipeStats{}
+	}
+	// Two TCP sockets (including kTLS ones) are copied with splice() by the
+	// kernel, so we ask the sockets how long they've been idle instead
+	clientTCP, clientOk := client.(*net.TCPConn)
+	targetTCP, targetOk := target.(*net.TCPConn)
+	if clientOk && targetOk && !opts.NoSplice {
+		p.spliced = []*net.TCPConn{clientTCP, targetTCP}
+		p.stats.spliced.Store(clientTCP)
+	}
+	start := time.Now()
+	go p.watch(opts)
+
+	var wg sync.WaitGroup
+	var upstream, downstream int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		upstream = p.copy(target, client, &p.stats.upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		downstream = p.copy(client, target, &p.stats.downstream)
+	}()
+	wg.Wait()
+	close(p.done)
+	p.finish(PipeClosed, nil)
+	p.stats.spliced.Store(nil)
+	p.stats.upstream.Store(upstream)
+	p.stats.downstream.Store(downstream)
+
+	return PipeResult{
+		Upstream:   upstream,
+		Downstream: downstream,
+		Duration:   time.Since(start),
+		Reason:     p.reason,
+		Err:        p.err,
+	}
+}
+
+type pipe struct {
+	client io.ReadWriteCloser
+	target io.ReadWriteCloser
+
+	activity chan struct{}
+	done     chan struct{}
+	spliced  []*net.TCPConn
+	stats    *PipeStats
+
+	once   sync.Once
+	closed atomic.Bool
+	reason string
+	err    error
+}
+
+// finish closes both sides, only the first reason is recorded
+func (p *pipe) finish(reason string, err error) {
+	p.once.Do(func() {
+		p.reason = reason
+		p.err = err
+		p.closed.Store(true)
+		p.client.Close()
+		p.target.Close()
+	})
+}
+
+// copy moves data from src to dst and then half-closes dst, counting what it
+// reads into count
+func (p *pipe) copy(dst io.Writer, src io.Reader, count *atomic.Int64) int64 {
+	if p.spliced == nil {
+		src = activityReader{r: src, activity: p.activity, count: count}
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		// Errors are expected once we've closed the connections ourselves
+		if !p.closed.Load() && !errors.Is(err, net.ErrClosed) {
+			slog.Printf("Failed copying data: %v", err)
+			p.finish(PipeError, err)
+		}
+		return n
+	}
+	if hc, ok := dst.(halfCloser); ok {
+		err = hc.CloseWrite()
+		if err == nil {
+			return n
+		}
+	}
+	p.finish(PipeClosed, nil)
+	return n
+}
+
+// watch enforces the idle and max lifetime timeouts
+func (p *pipe) watch(opts PipeOptions) {
+	var idle, lifetime <-chan time.Time
+	var idleTimer *time.Timer
+	var poll <-chan time.Time
+	if opts.IdleTimeout > 0 {
+		if p.spliced != nil {
+			ticker := time.NewTicker(idlePollInterval(opts.IdleTimeout))
+			defer ticker.Stop()
+			poll = ticker.C
+		} else {
+			idleTimer = time.NewTimer(opts.IdleTimeout)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+	}
+	if opts.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(opts.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.activity:
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(opts.IdleTimeout)
+			}
+		case <-idle:
+			p.finish(PipeIdleTimeout, nil)
+			return
+		case <-poll:
+			if p.idleFor() >= opts.IdleTimeout {
+				p.finish(PipeIdleTimeout, nil)
+				return
+			}
+		case <-lifetime:
+			p.finish(PipeMaxLifetime, nil)
+			return
+		}
+	}
+}
+
+// idlePollInterval is how often spliced sockets are checked for activity
+func idlePollInterval(idle time.Duration) time.Duration {
+	interval := idle / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// idleFor returns how long it has been since either spliced socket received
+// any data, using the kernel's TCP_INFO
+func (p *pipe) idleFor() time.Duration {
+	var idle time.Duration = -1
+	for _, conn := range p.spliced {
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			return 0
+		}
+		var info *unix.TCPInfo
+		rawConn.Control(func(fd uintptr) {
+			info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		})
+		if err != nil || info == nil {
+			// If we can't tell, assume the connection is active
+			return 0
+		}
+		last := time.Duration(info.Last_data_recv) * time.Millisecond
+		if idle < 0 || last < idle {
+			idle = last
+		}
+	}
+	return idle
+}
+
+// activityReader lets the watcher know that data is flowing
+type activityReader struct {
+	r        io.Reader
+	activity chan struct{}
+	count    *atomic.Int64
+}
+
+func (a activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.count.Add(int64(n))
+		select {
+		case a.activity <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,426 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// The proxy-to-proxy handshake is a small binary header that is sent by the
+// internal proxy as soon as the tunnel to the remote proxy is established.
+//
+//	+-------+---------+--------+------+---------+--------------+----------+
+//	| magic | version | family | port | address | metadata len | metadata |
+//	|  4B   |   1B    |   1B   |  2B  | 4B/16B  |      2B      |   TLVs   |
+//	+-------+---------+--------+------+---------+--------------+----------+
+//
+// The remote proxy answers with a reply of magic, version and a status byte
+// (and from version 2 a flags byte).
+// All integers are big endian. The fixed part of the header will never change
+// between versions, anything new is carried as TLV metadata which older
+// proxies skip.
+
+const (
+	// Version 2 adds a flags byte to the reply
+	ProtocolVersion uint8 = 2
+
+	FamilyIPv4 uint8 = 4
+	FamilyIPv6 uint8 = 6
+
+	// MaxMetadataLength caps how much TLV data we will read from a peer
+	MaxMetadataLength = 4096
+)
+
+// Status is returned by the remote proxy once it has tried to connect to the
+// original destination
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusFailure
+	StatusConnectionRefused
+	StatusTimeout
+	StatusUnreachable
+	StatusPolicyDenied
+	StatusLoopDetected
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusFailure:
+		return "failure"
+	case StatusConnectionRefused:
+		return "connection refused"
+	case StatusTimeout:
+		return "timeout"
+	case StatusUnreachable:
+		return "unreachable"
+	case StatusPolicyDenied:
+		return "policy denied"
+	case StatusLoopDetected:
+		return "loop detected"
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(s))
+}
+
+// StatusFromError maps the error from dialling the original destination to
+// the status we return to the remote proxy
+func StatusFromError(err error) Status {
+	if err == nil {
+		return StatusOK
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return StatusConnectionRefused
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return StatusUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return StatusTimeout
+	}
+	return StatusFailure
+}
+
+var protocolMagic = [4]byte{'S', 'M', 'S', 'H'}
+
+// Metadata types carried in the header
+const (
+	TLVSourcePort uint8 = 1 // Port the application connected from
+	TLVKTLS       uint8 = 2 // The internal proxy would like to switch to kTLS
+	TLVDatagram   uint8 = 3 // The tunnel carries framed UDP datagrams
+	TLVConnection uint8 = 4 // ID of the connection in the access logs
+	TLVSourcePod  uint8 = 5 // Name of the pod the application runs in
+)
+
+// Reply flags
+const (
+	ReplyFlagKTLS uint8 = 1 << iota // The remote proxy has switched to kTLS
+)
+
+// TLV is a single type/length/value metadata entry in the handshake header
+type TLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// Header is the original destination (and anything else we want to tell the
+// remote proxy) sent at the start of every tunnel
+type Header struct {
+	Version  uint8
+	Family   uint8
+	IP       net.IP
+	Port     uint16
+	Metadata []TLV
+
+	// Legacy is set when the peer sent the original "ip:port" string
+	Legacy bool
+}
+
+// NewHeader builds a header for the destination address and port
+func NewHeader(address string, port uint16) (*Header, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("unable to parse destination address [%s]", address)
+	}
+	h := &Header{
+		Version: ProtocolVersion,
+		Family:  FamilyIPv6,
+		IP:      ip,
+		Port:    port,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		h.Family = FamilyIPv4
+		h.IP = ip4
+	}
+	return h, nil
+}
+
+// Address returns the destination in a form that can be passed to net.Dial
+func (h *Header) Address() string {
+	return net.JoinHostPort(h.IP.String(), strconv.Itoa(int(h.Port)))
+}
+
+// Lookup returns the value of the first TLV of type t
+func (h *Header) Lookup(t uint8) ([]byte, bool) {
+	for x := range h.Metadata {
+		if h.Metadata[x].Type == t {
+			return h.Metadata[x].Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetSourcePort records the port the application connected from
+func (h *Header) SetSourcePort(port uint16) {
+	h.Metadata = append(h.Metadata, TLV{Type: TLVSourcePort, Value: binary.BigEndian.AppendUint16(nil, port)})
+}
+
+// SourcePort returns the port the application connected from, or zero
+func (h *Header) SourcePort() uint16 {
+	v, ok := h.Lookup(TLVSourcePort)
+	if !ok || len(v) != 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v)
+}
+
+// SetValue adds a TLV of type t, empty values are left out
+func (h *Header) SetValue(t uint8, value string) {
+	if value == "" {
+		return
+	}
+	h.Metadata = append(h.Metadata, TLV{Type: t, Value: []byte(value)})
+}
+
+// Value returns the value of a TLV of type t as a string, or ""
+func (h *Header) Value(t uint8) string {
+	v, _ := h.Lookup(t)
+	return string(v)
+}
+
+// Marshal encodes the header into its wire format
+func (h *Header) Marshal() ([]byte, error) {
+	var ip net.IP
+	switch h.Family {
+	case FamilyIPv4:
+		ip = h.IP.To4()
+	case FamilyIPv6:
+		ip = h.IP.To16()
+	default:
+		return nil, fmt.Errorf("unknown address family [%d]", h.Family)
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("address [%s] doesn't match family [%d]", h.IP, h.Family)
+	}
+
+	var metadata bytes.Buffer
+	for x := range h.Metadata {
+		if len(h.Metadata[x].Value) > 0xffff {
+			return nil, fmt.Errorf("metadata type [%d] is too large", h.Metadata[x].Type)
+		}
+		metadata.WriteByte(h.Metadata[x].Type)
+		binary.Write(&metadata, binary.BigEndian, uint16(len(h.Metadata[x].Value)))
+		metadata.Write(h.Metadata[x].Value)
+	}
+	if metadata.Len() > MaxMetadataLength {
+		return nil, fmt.Errorf("metadata length [%d] exceeds maximum [%d]", metadata.Len(), MaxMetadataLength)
+	}
+
+	var b bytes.Buffer
+	b.Write(protocolMagic[:])
+	b.WriteByte(h.Version)
+	b.WriteByte(h.Family)
+	binary.Write(&b, binary.BigEndian, h.Port)
+	b.Write(ip)
+	binary.Write(&b, binary.BigEndian, uint16(metadata.Len()))
+	b.Write(metadata.Bytes())
+	return b.Bytes(), nil
+}
+
+// WriteHeader sends the header to the remote proxy
+func WriteHeader(w io.Writer, h *Header) error {
+	b, err := h.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadHeader reads a header from the internal proxy, if the peer is an older
+// proxy that sends the raw "ip:port" string then that is parsed instead
+func ReadHeader(r io.Reader) (*Header, error) {
+	var magic [4]byte
+	n, err := io.ReadFull(r, magic[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return parseLegacyHeader(magic[:n], r)
+		}
+		return nil, err
+	}
+	if magic != protocolMagic {
+		return parseLegacyHeader(magic[:], r)
+	}
+
+	fixed := make([]byte, 4)
+	if _, err = io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	h := &Header{
+		Version: fixed[0],
+		Family:  fixed[1],
+		Port:    binary.BigEndian.Uint16(fixed[2:]),
+	}
+
+	switch h.Family {
+	case FamilyIPv4:
+		h.IP = make(net.IP, net.IPv4len)
+	case FamilyIPv6:
+		h.IP = make(net.IP, net.IPv6len)
+	default:
+		return nil, fmt.Errorf("unknown address family [%d]", h.Family)
+	}
+	if _, err = io.ReadFull(r, h.IP); err != nil {
+		return nil, fmt.Errorf("reading address: %v", err)
+	}
+
+	var length uint16
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("reading metadata length: %v", err)
+	}
+	if length > MaxMetadataLength {
+		return nil, fmt.Errorf("metadata length [%d] exceeds maximum [%d]", length, MaxMetadataLength)
+	}
+	metadata := make([]byte, length)
+	if _, err = io.ReadFull(r, metadata); err != nil {
+		return nil, fmt.Errorf("reading metadata: %v", err)
+	}
+
+	// Walk the TLVs, a truncated entry means the header is corrupt
+	for len(metadata) > 0 {
+		if len(metadata) < 3 {
+			return nil, fmt.Errorf("truncated metadata")
+		}
+		t := metadata[0]
+		l := int(binary.BigEndian.Uint16(metadata[1:3]))
+		if len(metadata) < 3+l {
+			return nil, fmt.Errorf("truncated metadata type [%d]", t)
+		}
+		h.Metadata = append(h.Metadata, TLV{Type: t, Value: metadata[3 : 3+l]})
+		metadata = metadata[3+l:]
+	}
+	return h, nil
+}
+
+// parseLegacyHeader handles the original handshake, where the destination was
+// written as a plain string in a single write
+func parseLegacyHeader(prefix []byte, r io.Reader) (*Header, error) {
+	tmp := make([]byte, 256)
+	n := copy(tmp, prefix)
+	// A short legacy address may already be entirely in the prefix
+	if _, _, err := net.SplitHostPort(string(tmp[:n])); err != nil {
+		read, err := r.Read(tmp[n:])
+		if err != nil {
+			return nil, fmt.Errorf("reading legacy header: %v", err)
+		}
+		n += read
+	}
+	host, port, err := net.SplitHostPort(string(tmp[:n]))
+	if err != nil {
+		return nil, fmt.Errorf("parsing legacy header [%s]: %v", string(tmp[:n]), err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parsing legacy port [%s]: %v", port, err)
+	}
+	h, err := NewHeader(host, uint16(p))
+	if err != nil {
+		return nil, err
+	}
+	h.Version = 0
+	h.Legacy = true
+	return h, nil
+}
+
+// Reply is the answer from the remote proxy
+type Reply struct {
+	Version uint8
+	Status  Status
+	Flags   uint8 // Only sent from version 2
+}
+
+// WriteReply answers the internal proxy, legacy peers just expect a single byte
+func WriteReply(w io.Writer, h *Header, status Status) error {
+	return WriteReplyFlags(w, h, status, 0)
+}
+
+// WriteReplyFlags answers the internal proxy with flags for the features that
+// the remote proxy has agreed to, peers older than version 2 don't get them
+func WriteReplyFlags(w io.Writer, h *Header, status Status, flags uint8) error {
+	if h.Legacy {
+		if status != StatusOK {
+			return nil
+		}
+		_, err := w.Write([]byte{'Y'})
+		return err
+	}
+	version := h.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	b := append(protocolMagic[:], version, uint8(status))
+	if version >= 2 {
+		b = append(b, flags)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ErrLegacyPeer is returned by ReadReply when the remote proxy is older and
+// only understands the original "ip:port" handshake
+var ErrLegacyPeer = errors.New("remote proxy only supports the legacy handshake")
+
+// ReadReply reads the status that the remote proxy returned
+func ReadReply(r io.Reader) (*Reply, error) {
+	b := make([]byte, len(protocolMagic)+2)
+	// An older proxy can't parse our header, it closes the connection without
+	// answering, so anything other than our magic means a legacy peer
+	n, err := io.ReadFull(r, b[:1])
+	if n == 0 && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)) {
+		return nil, ErrLegacyPeer
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading reply: %w", err)
+	}
+	if b[0] != protocolMagic[0] {
+		return nil, ErrLegacyPeer
+	}
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return nil, fmt.Errorf("reading reply: %w", err)
+	}
+	if !bytes.Equal(b[:len(protocolMagic)], protocolMagic[:]) {
+		return nil, fmt.Errorf("invalid reply from remote proxy")
+	}
+	reply := &Reply{Version: b[4], Status: Status(b[5])}
+	if reply.Version >= 2 {
+		flags := make([]byte, 1)
+		if _, err := io.ReadFull(r, flags); err != nil {
+			return nil, fmt.Errorf("reading reply flags: %v", err)
+		}
+		reply.Flags = flags[0]
+	}
+	return reply, nil
+}
+
+// WriteLegacyHeader sends the destination as the original "ip:port" string,
+// the metadata can't be sent to older proxies
+func WriteLegacyHeader(w io.Writer, h *Header) error {
+	_, err := w.Write([]byte(h.Address()))
+	return err
+}
+
+// ReadLegacyReply reads the single 'Y' an older proxy sends once it has
+// connected to the original destination, it closes the connection if it
+// couldn't
+func ReadLegacyReply(r io.Reader) (*Reply, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	if errors.Is(err, io.EOF) {
+		return &Reply{Status: StatusFailure}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading legacy reply: %w", err)
+	}
+	if b[0] != 'Y' {
+		return nil, fmt.Errorf("invalid legacy reply [%x] from remote proxy", b[0])
+	}
+	return &Reply{Status: StatusOK}, nil
+}
@@ -0,0 +1,261 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		port     uint16
+		family   uint8
+		metadata []TLV
+	}{
+		{name: "ipv4", address: "10.244.1.5", port: 8080, family: FamilyIPv4},
+		{name: "ipv6", address: "fd00::1:5", port: 443, family: FamilyIPv6},
+		{name: "ipv4 mapped", address: "::ffff:10.0.0.1", port: 80, family: FamilyIPv4},
+		{
+			name:    "metadata",
+			address: "10.0.0.1",
+			port:    53,
+			family:  FamilyIPv4,
+			metadata: []TLV{
+				{Type: TLVSourcePort, Value: []byte{0x9c, 0x40}},
+				{Type: TLVDatagram, Value: []byte{}},
+				{Type: TLVConnection, Value: []byte("0123456789abcdef")},
+				{Type: 200, Value: []byte("unknown types are kept")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHeader(tt.address, tt.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Metadata = tt.metadata
+			b, err := h.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadHeader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Version != ProtocolVersion || got.Family != tt.family || got.Port != tt.port || got.Legacy {
+				t.Errorf("got version %d family %d port %d legacy %v", got.Version, got.Family, got.Port, got.Legacy)
+			}
+			if !got.IP.Equal(net.ParseIP(tt.address)) {
+				t.Errorf("got address %s, want %s", got.IP, tt.address)
+			}
+			if len(got.Metadata) != len(tt.metadata) {
+				t.Fatalf("got %d TLVs, want %d", len(got.Metadata), len(tt.metadata))
+			}
+			for i := range tt.metadata {
+				if got.Metadata[i].Type != tt.metadata[i].Type || !bytes.Equal(got.Metadata[i].Value, tt.metadata[i].Value) {
+					t.Errorf("TLV %d: got %v, want %v", i, got.Metadata[i], tt.metadata[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderHelpers(t *testing.T) {
+	h, err := NewHeader("10.0.0.1", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetSourcePort(40000)
+	h.SetValue(TLVSourcePod, "pod-01")
+	h.SetValue(TLVConnection, "")
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SourcePort() != 40000 {
+		t.Errorf("got source port %d", got.SourcePort())
+	}
+	if got.Value(TLVSourcePod) != "pod-01" {
+		t.Errorf("got source pod %q", got.Value(TLVSourcePod))
+	}
+	if _, ok := got.Lookup(TLVConnection); ok {
+		t.Errorf("empty values shouldn't be sent")
+	}
+	if got.Address() != "10.0.0.1:80" {
+		t.Errorf("got address %s", got.Address())
+	}
+}
+
+func TestReadLegacyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		address string
+		wantErr bool
+	}{
+		{name: "ipv4", input: "10.244.1.5:8080", address: "10.244.1.5:8080"},
+		{name: "ipv6", input: "[fd00::5]:443", address: "[fd00::5]:443"},
+		{name: "short", input: "1.1.1.1:1", address: "1.1.1.1:1"},
+		{name: "shorter than the magic", input: "::1", wantErr: true},
+		{name: "hostname", input: "example.com:80", wantErr: true},
+		{name: "bad port", input: "10.0.0.1:http", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ReadHeader(bytes.NewReader([]byte(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", h.Address())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.Legacy || h.Version != 0 {
+				t.Errorf("got legacy %v version %d", h.Legacy, h.Version)
+			}
+			if h.Address() != tt.address {
+				t.Errorf("got %s, want %s", h.Address(), tt.address)
+			}
+		})
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	valid, err := NewHeader("10.0.0.1", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid.SetSourcePort(1)
+	b, err := valid.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withLength := func(b []byte, length uint16) []byte {
+		b = append([]byte{}, b...)
+		b[12], b[13] = byte(length>>8), byte(length)
+		return b
+	}
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "unknown family", input: append(append(protocolMagic[:], 2, 5), make([]byte, 10)...)},
+		{name: "truncated address", input: b[:10]},
+		{name: "truncated metadata", input: b[:len(b)-1]},
+		{name: "metadata too long", input: withLength(b, MaxMetadataLength+1)},
+		{name: "partial TLV", input: append(withLength(b[:14], 2), 1, 0)},
+		{name: "TLV longer than metadata", input: append(withLength(b[:14], 3), 1, 0, 9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(tt.input)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint8
+		status  Status
+		flags   uint8
+		want    Reply
+	}{
+		{name: "version 1", version: 1, status: StatusOK, flags: ReplyFlagKTLS, want: Reply{Version: 1, Status: StatusOK}},
+		{name: "version 2", version: 2, status: StatusOK, flags: ReplyFlagKTLS, want: Reply{Version: 2, Status: StatusOK, Flags: ReplyFlagKTLS}},
+		{name: "failure", version: 2, status: StatusPolicyDenied, want: Reply{Version: 2, Status: StatusPolicyDenied}},
+		{name: "newer peer", version: ProtocolVersion + 1, status: StatusOK, want: Reply{Version: ProtocolVersion, Status: StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := WriteReplyFlags(&b, &Header{Version: tt.version}, tt.status, tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadReply(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyReplies(t *testing.T) {
+	// Legacy internal proxies only get a 'Y' when we connected
+	var b bytes.Buffer
+	err := WriteReply(&b, &Header{Legacy: true}, StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "Y" {
+		t.Errorf("got %q, want Y", b.String())
+	}
+	b.Reset()
+	err = WriteReply(&b, &Header{Legacy: true}, StatusConnectionRefused)
+	if err != nil || b.Len() != 0 {
+		t.Errorf("got %q (%v), want nothing", b.String(), err)
+	}
+
+	tests := []struct {
+		name       string
+		input      []byte
+		legacyPeer bool
+		status     Status
+	}{
+		{name: "closed without a reply", input: nil, legacyPeer: true, status: StatusFailure},
+		{name: "connected", input: []byte{'Y'}, legacyPeer: true, status: StatusOK},
+		{name: "current peer", input: append(protocolMagic[:], 2, uint8(StatusOK), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadReply(bytes.NewReader(tt.input))
+			if errors.Is(err, ErrLegacyPeer) != tt.legacyPeer {
+				t.Fatalf("got %v, legacy peer %v", err, tt.legacyPeer)
+			}
+			if !tt.legacyPeer {
+				return
+			}
+			reply, err := ReadLegacyReply(bytes.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Status != tt.status {
+				t.Errorf("got %s, want %s", reply.Status, tt.status)
+			}
+		})
+	}
+
+	_, err = ReadReply(bytes.NewReader(protocolMagic[:3]))
+	if err == nil || errors.Is(err, ErrLegacyPeer) {
+		t.Errorf("a truncated reply isn't a legacy peer: %v", err)
+	}
+	_, err = ReadLegacyReply(bytes.NewReader([]byte{'N'}))
+	if err == nil {
+		t.Errorf("expected an error for an invalid legacy reply")
+	}
+	_, err = ReadLegacyReply(errReader{})
+	if err == nil {
+		t.Errorf("expected the read error")
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrClosedPipe }
@@ -0,0 +1,177 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+// lets the application behind the remote proxy see the real source of the
+// connection instead of the proxy itself.
+
+var proxyProtocolSignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtocolV2Proxy = 0x21 // version 2, PROXY command
+	proxyProtocolTCP4    = 0x11
+	proxyProtocolTCP6    = 0x21
+
+	pp2TypeSSL          = 0x20
+	pp2SubtypeSSLVer    = 0x21
+	pp2SubtypeSSLCN     = 0x22
+	pp2SubtypeSSLCipher = 0x23
+	pp2ClientSSL        = 0x01
+	pp2ClientCertConn   = 0x02
+
+	// Types 0xE0-0xEF are reserved for applications, we use the first one
+	// for the URI and DNS SANs of the verified peer certificate
+	pp2TypeSmeshIdentity = 0xE0
+)
+
+// ParseProxyProtocolPorts parses a comma separated list of ports that should
+// receive a PROXY protocol header, "*" enables it for every port
+func ParseProxyProtocolPorts(ports string) (map[uint16]bool, error) {
+	enabled := map[uint16]bool{}
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			enabled[0] = true
+			continue
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse proxy protocol port [%s]: %v", p, err)
+		}
+		enabled[uint16(port)] = true
+	}
+	return enabled, nil
+}
+
+// proxyProtocolEnabled checks if the application on port expects a header
+func (c *Config) proxyProtocolEnabled(port uint16) bool {
+	return c.ProxyProtocolPorts[0] || c.ProxyProtocolPorts[port]
+}
+
+// sendProxyProtocol writes the PROXY protocol header to the application if it
+// has been enabled for the destination port
+func (c *Config) sendProxyProtocol(w io.Writer, source, destination *net.TCPAddr, state *tls.ConnectionState) error {
+	if !c.proxyProtocolEnabled(uint16(destination.Port)) {
+		return nil
+	}
+	b, err := proxyProtocolHeader(source, destination, state)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// proxyProtocolHeader builds a v2 header, if the peer presented a certificate
+// then its identity is added as TLVs
+func proxyProtocolHeader(source, destination *net.TCPAddr, state *tls.ConnectionState) ([]byte, error) {
+	var addresses bytes.Buffer
+	family := byte(proxyProtocolTCP4)
+	src, dst := source.IP.To4(), destination.IP.To4()
+	if src == nil || dst == nil {
+		// Mixed families are sent as IPv6 (v4 addresses are mapped)
+		family = proxyProtocolTCP6
+		src, dst = source.IP.To16(), destination.IP.To16()
+		if src == nil || dst == nil {
+			return nil, fmt.Errorf("invalid addresses %s -> %s", source, destination)
+		}
+	}
+	addresses.Write(src)
+	addresses.Write(dst)
+	binary.Write(&addresses, binary.BigEndian, uint16(source.Port))
+	binary.Write(&addresses, binary.BigEndian, uint16(destination.Port))
+
+	if state != nil {
+		addresses.Write(proxyProtocolSSL(state))
+		if identity := peerIdentity(state); identity != "" {
+			addresses.Write(proxyProtocolTLV(pp2TypeSmeshIdentity, []byte(identity)))
+		}
+	}
+
+	if addresses.Len() > 0xffff {
+		return nil, fmt.Errorf("proxy protocol header is too large")
+	}
+	var b bytes.Buffer
+	b.Write(proxyProtocolSignature)
+	b.WriteByte(proxyProtocolV2Proxy)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(addresses.Len()))
+	b.Write(addresses.Bytes())
+	return b.Bytes(), nil
+}
+
+// proxyProtocolSSL builds the PP2_TYPE_SSL TLV and its sub-TLVs
+func proxyProtocolSSL(state *tls.ConnectionState) []byte {
+	var ssl bytes.Buffer
+	client := byte(pp2ClientSSL)
+	if len(state.PeerCertificates) > 0 {
+		client |= pp2ClientCertConn
+	}
+	ssl.WriteByte(client)
+	// verify is zero when the client presented a certificate that was verified
+	var verify uint32 = 1
+	if len(state.VerifiedChains) > 0 {
+		verify = 0
+	}
+	binary.Write(&ssl, binary.BigEndian, verify)
+	ssl.Write(proxyProtocolTLV(pp2SubtypeSSLVer, []byte(tls.VersionName(state.Version))))
+	ssl.Write(proxyProtocolTLV(pp2SubtypeSSLCipher, []byte(tls.CipherSuiteName(state.CipherSuite))))
+	if len(state.PeerCertificates) > 0 {
+		ssl.Write(proxyProtocolTLV(pp2SubtypeSSLCN, []byte(state.PeerCertificates[0].Subject.CommonName)))
+	}
+	return proxyProtocolTLV(pp2TypeSSL, ssl.Bytes())
+}
+
+func proxyProtocolTLV(t byte, value []byte) []byte {
+	b := make([]byte, 3, 3+len(value))
+	b[0] = t
+	binary.BigEndian.PutUint16(b[1:], uint16(len(value)))
+	return append(b, value...)
+}
+
+// peerIdentity returns the SANs of the verified peer certificate
+func peerIdentity(state *tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return strings.Join(certificateSANs(state.VerifiedChains[0][0]), ",")
+}
+
+// certificateSANs returns the URI, DNS and IP SANs of cert
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// sourceAddress is the address of the application that made the original
+// connection, the remote proxy's address with the port it told us about
+func sourceAddress(remote string, sourcePort uint16) *net.TCPAddr {
+	host, port, _ := net.SplitHostPort(remote)
+	p, _ := strconv.Atoi(port)
+	source := &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	if sourcePort != 0 {
+		source.Port = int(sourcePort)
+	}
+	return source
+}
@@ -0,0 +1,167 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	identity, _ := url.Parse("spiffe://cluster.local/ns/default/sa/client")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "client"},
+		URIs:     []*url.URL{identity},
+		DNSNames: []string{"client.default.svc"},
+	}
+	tests := []struct {
+		name        string
+		source      *net.TCPAddr
+		destination *net.TCPAddr
+		state       *tls.ConnectionState
+		family      byte
+		addresses   []byte
+		tlvs        []byte
+	}{
+		{
+			name:        "ipv4",
+			source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000},
+			destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8080},
+			family:      proxyProtocolTCP4,
+			addresses:   []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x9c, 0x40, 0x1f, 0x90},
+		},
+		{
+			name:        "ipv6",
+			source:      &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1},
+			destination: &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 2},
+			family:      proxyProtocolTCP6,
+			addresses: append(append(net.ParseIP("fd00::1").To16(), net.ParseIP("fd00::2").To16()...),
+				0, 1, 0, 2),
+		},
+		{
+			name:        "mixed families",
+			source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			destination: &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 2},
+			family:      proxyProtocolTCP6,
+			addresses: append(append(net.ParseIP("10.0.0.1").To16(), net.ParseIP("fd00::2").To16()...),
+				0, 1, 0, 2),
+		},
+		{
+			name:        "tls without a client certificate",
+			source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2},
+			state:       &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+			family:      proxyProtocolTCP4,
+			addresses:   []byte{10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2},
+			tlvs: proxyProtocolTLV(pp2TypeSSL, append([]byte{pp2ClientSSL, 0, 0, 0, 1},
+				append(proxyProtocolTLV(pp2SubtypeSSLVer, []byte("TLS 1.3")),
+					proxyProtocolTLV(pp2SubtypeSSLCipher, []byte("TLS_AES_128_GCM_SHA256"))...)...)),
+		},
+		{
+			name:        "tls with a verified client certificate",
+			source:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+			destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2},
+			state: &tls.ConnectionState{
+				Version:          tls.VersionTLS13,
+				CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			},
+			family:    proxyProtocolTCP4,
+			addresses: []byte{10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2},
+			tlvs: append(proxyProtocolTLV(pp2TypeSSL, append([]byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0},
+				append(append(proxyProtocolTLV(pp2SubtypeSSLVer, []byte("TLS 1.3")),
+					proxyProtocolTLV(pp2SubtypeSSLCipher, []byte("TLS_AES_128_GCM_SHA256"))...),
+					proxyProtocolTLV(pp2SubtypeSSLCN, []byte("client"))...)...)),
+				proxyProtocolTLV(pp2TypeSmeshIdentity, []byte("spiffe://cluster.local/ns/default/sa/client,client.default.svc"))...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := proxyProtocolHeader(tt.source, tt.destination, tt.state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, proxyProtocolSignature) {
+				t.Fatalf("missing signature: %x", b)
+			}
+			b = b[len(proxyProtocolSignature):]
+			if b[0] != proxyProtocolV2Proxy || b[1] != tt.family {
+				t.Errorf("got command %#x family %#x, want %#x %#x", b[0], b[1], proxyProtocolV2Proxy, tt.family)
+			}
+			want := append(append([]byte{}, tt.addresses...), tt.tlvs...)
+			if length := binary.BigEndian.Uint16(b[2:4]); int(length) != len(want) || len(b[4:]) != len(want) {
+				t.Fatalf("got length %d with %d bytes, want %d", length, len(b[4:]), len(want))
+			}
+			if !bytes.Equal(b[4:], want) {
+				t.Errorf("got %x, want %x", b[4:], want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderInvalid(t *testing.T) {
+	_, err := proxyProtocolHeader(&net.TCPAddr{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, nil)
+	if err == nil {
+		t.Fatal("expected an error for a missing address")
+	}
+}
+
+func TestParseProxyProtocolPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   string
+		want    []uint16
+		wantErr bool
+	}{
+		{name: "empty", ports: ""},
+		{name: "list", ports: "80, 443,,8080", want: []uint16{80, 443, 8080}},
+		{name: "every port", ports: "*", want: []uint16{0}},
+		{name: "not a number", ports: "http", wantErr: true},
+		{name: "out of range", ports: "70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProxyProtocolPorts(tt.ports)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for _, p := range tt.want {
+				if !got[p] {
+					t.Errorf("port %d isn't enabled in %v", p, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyProtocolEnabled(t *testing.T) {
+	c := &Config{ProxyProtocolPorts: map[uint16]bool{8080: true}}
+	var b bytes.Buffer
+	source := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	err := c.sendProxyProtocol(&b, source, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}, nil)
+	if err != nil || b.Len() != 0 {
+		t.Errorf("port 80 shouldn't get a header: %x (%v)", b.Bytes(), err)
+	}
+	err = c.sendProxyProtocol(&b, source, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8080}, nil)
+	if err != nil || !bytes.HasPrefix(b.Bytes(), proxyProtocolSignature) {
+		t.Errorf("port 8080 should get a header: %x (%v)", b.Bytes(), err)
+	}
+	c.ProxyProtocolPorts = map[uint16]bool{0: true}
+	if !c.proxyProtocolEnabled(9999) {
+		t.Errorf("* should enable every port")
+	}
+}
@@ -0,0 +1,22 @@
+package connection
+
+import (
+	"net"
+
+	"github.com/gookit/slog"
+)
+
+// rejectConnection is used once the application has already had its connect()
+// accepted by the internal proxy, so the closest we can get to the original
+// failure is resetting the connection (SO_LINGER 0) rather than a clean close.
+func rejectConnection(conn net.Conn, record *AccessRecord, status Status) {
+	slog.Printf("Rejecting connection %s -> %s [%s]", conn.RemoteAddr(), record.Destination, status)
+	record.reject(status)
+	rejectedConnections.WithLabelValues(status.String()).Inc()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		err := tcpConn.SetLinger(0)
+		if err != nil {
+			slog.Printf("Failed to reset connection: %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The UDP relay only sees the address a datagram came from, to find the
+// original destination we need the cookie of the sending socket (which is
+// what the eBPF uses as the key). sock_diag gives us the cookie of every UDP
+// socket in the pod's network namespace.
+
+const sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+
+// inetDiagSockID matches struct inet_diag_sockid
+type inetDiagSockID struct {
+	SPort  [2]byte
+	DPort  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// inetDiagReqV2 matches struct inet_diag_req_v2
+type inetDiagReqV2 struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	Pad      uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// inetDiagMsg matches struct inet_diag_msg
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+// udpSocketCookie finds the cookie of the local UDP socket bound to addr
+func udpSocketCookie(addr *net.UDPAddr) (uint64, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return 0, fmt.Errorf("opening sock_diag socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	req := inetDiagReqV2{
+		Family:   unix.AF_INET,
+		Protocol: unix.IPPROTO_UDP,
+		States:   0xffffffff,
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.NativeEndian, unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + unsafe.Sizeof(req)),
+		Type:  sockDiagByFamily,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+	})
+	binary.Write(&b, binary.NativeEndian, req)
+
+	err = unix.Sendto(fd, b.Bytes(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return 0, fmt.Errorf("sending sock_diag request: %v", err)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return 0, fmt.Errorf("reading sock_diag response: %v", err)
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return 0, fmt.Errorf("parsing sock_diag response: %v", err)
+		}
+		for _, m := range messages {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return 0, fmt.Errorf("no UDP socket found for %s", addr)
+			case unix.NLMSG_ERROR:
+				return 0, fmt.Errorf("sock_diag returned an error")
+			}
+			var msg inetDiagMsg
+			err = binary.Read(bytes.NewReader(m.Data), binary.NativeEndian, &msg)
+			if err != nil {
+				continue
+			}
+			if int(binary.BigEndian.Uint16(msg.ID.SPort[:])) != addr.Port {
+				continue
+			}
+			// Sockets bound to 0.0.0.0 match any local address
+			src := net.IP(msg.ID.Src[:4])
+			if !src.IsUnspecified() && !src.Equal(addr.IP) {
+				continue
+			}
+			return uint64(msg.ID.Cookie[0]) | uint64(msg.ID.Cookie[1])<<32, nil
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// When the proxy accepts a connection from an intercepted socket the eBPF
+// links the cookie of the accepted socket (map_proxy_socks) to the cookie of
+// the application's socket, which is the key for the original Socket record.
+
+// socketRecord matches struct Socket in the eBPF
+type socketRecord struct {
+	SrcAddr uint32
+	SrcPort uint16
+	_       [2]byte
+	DstAddr uint32
+	DstPort uint16
+	_       [2]byte
+}
+
+// socketRecord6 matches struct Socket6 in the eBPF
+type socketRecord6 struct {
+	SrcAddr [16]byte
+	DstAddr [16]byte
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Socket is the connection the application originally made
+type Socket struct {
+	Cookie      uint64
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// socketCookie returns the SO_COOKIE of a connection
+func socketCookie(conn net.Conn) (uint64, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, fmt.Errorf("not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cookie uint64
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cookie, sockErr = unix.GetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_COOKIE)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, fmt.Errorf("getsockopt SO_COOKIE failed: %v", sockErr)
+	}
+	return cookie, nil
+}
+
+// LookupSocket finds the original Socket for a connection accepted by the
+// internal proxy
+func (c *Config) LookupSocket(conn net.Conn) (*Socket, error) {
+	if c.Socks == nil || c.ProxySocks == nil {
+		return nil, fmt.Errorf("no socket maps")
+	}
+	cookie, err := socketCookie(conn)
+	if err != nil {
+		return nil, err
+	}
+	var appCookie uint64
+	err = c.ProxySocks.Lookup(&cookie, &appCookie)
+	if err != nil {
+		return nil, fmt.Errorf("looking up proxy socket cookie %d: %v", cookie, err)
+	}
+	// The link is only needed once
+	c.ProxySocks.Delete(&cookie)
+
+	var record socketRecord
+	err = c.Socks.Lookup(&appCookie, &record)
+	if err == nil {
+		return record.socket(appCookie), nil
+	}
+	if c.Socks6 == nil {
+		return nil, fmt.Errorf("looking up socket cookie %d: %v", appCookie, err)
+	}
+	var record6 socketRecord6
+	err = c.Socks6.Lookup(&appCookie, &record6)
+	if err != nil {
+		return nil, fmt.Errorf("looking up socket cookie %d: %v", appCookie, err)
+	}
+	return record6.socket(appCookie), nil
+}
+
+func (r socketRecord) socket(cookie uint64) *Socket {
+	sock := &Socket{
+		Cookie:      cookie,
+		Source:      &net.TCPAddr{IP: make(net.IP, net.IPv4len), Port: int(r.SrcPort)},
+		Destination: &net.TCPAddr{IP: make(net.IP, net.IPv4len), Port: int(r.DstPort)},
+	}
+	binary.BigEndian.PutUint32(sock.Source.IP, r.SrcAddr)
+	binary.BigEndian.PutUint32(sock.Destination.IP, r.DstAddr)
+	return sock
+}
+
+func (r socketRecord6) socket(cookie uint64) *Socket {
+	return &Socket{
+		Cookie:      cookie,
+		Source:      &net.TCPAddr{IP: net.IP(r.SrcAddr[:]), Port: int(r.SrcPort)},
+		Destination: &net.TCPAddr{IP: net.IP(r.DstAddr[:]), Port: int(r.DstPort)},
+	}
+}
+
+// Sockets returns every application connection in the socket maps
+func (c *Config) Sockets() ([]*Socket, error) {
+	var sockets []*Socket
+	var cookie uint64
+	if c.Socks != nil {
+		var record socketRecord
+		entries := c.Socks.Iterate()
+		for entries.Next(&cookie, &record) {
+			sockets = append(sockets, record.socket(cookie))
+		}
+		if err := entries.Err(); err != nil {
+			return nil, fmt.Errorf("reading map_socks: %v", err)
+		}
+	}
+	if c.Socks6 != nil {
+		var record6 socketRecord6
+		entries := c.Socks6.Iterate()
+		for entries.Next(&cookie, &record6) {
+			sockets = append(sockets, record6.socket(cookie))
+		}
+		if err := entries.Err(); err != nil {
+			return nil, fmt.Errorf("reading map_socks6: %v", err)
+		}
+	}
+	return sockets, nil
+}
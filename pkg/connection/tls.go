@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/slog"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// How many peer sessions the internal proxy remembers for resumption
+	clientSessionCacheSize = 1024
+	// How often the server side session ticket key is replaced, previous keys
+	// are kept around so tickets issued just before a rotation still resume
+	ticketKeyRotation = time.Hour
+	ticketKeyHistory  = 3
+)
+
+// tlsConfigs holds the TLS configuration shared by every connection, so that
+// the CA pool and key pair are parsed once and sessions can be resumed
+type tlsConfigs struct {
+	client *tls.Config
+	server *tls.Config
+
+	certificate atomic.Pointer[tls.Certificate]
+	ticketKeys  [][32]byte
+}
+
+var tlsMutex sync.Mutex
+
+// tlsConfigs returns the shared configurations, building them on first use
+func (c *Config) tlsConfigs() (*tlsConfigs, error) {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+	if c.tls != nil {
+		return c.tls, nil
+	}
+	certs := c.LoadedCertificates()
+	if certs == nil {
+		return nil, fmt.Errorf("no certificates loaded")
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(certs.ca) {
+		return nil, fmt.Errorf("could not append CA")
+	}
+
+	t := &tlsConfigs{}
+	err := t.setCertificate(certs)
+	if err != nil {
+		return nil, err
+	}
+
+	t.client = &tls.Config{
+		RootCAs: caCertPool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return t.certificate.Load(), nil
+		},
+		ClientSessionCache: tls.NewLRUClientSessionCache(clientSessionCacheSize),
+	} //<-- this is the key
+
+	t.server = &tls.Config{
+		ClientCAs: caCertPool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return t.certificate.Load(), nil
+		},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		// Always offer h2 so peers running in tunnel mode can multiplex
+		NextProtos: []string{http2.NextProtoTLS},
+	}
+	// Only peers with a certificate from our CA are allowed in
+	if c.InboundMode == InboundStrict {
+		t.server.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	err = t.rotateTicketKeys()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(ticketKeyRotation) {
+			err := t.rotateTicketKeys()
+			if err != nil {
+				slog.Errorf("unable to rotate session ticket keys [%v]", err)
+			}
+		}
+	}()
+
+	c.tls = t
+	return t, nil
+}
+
+func (t *tlsConfigs) setCertificate(certs *Certs) error {
+	certificate, err := tls.X509KeyPair(certs.cert, certs.key)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %v", err)
+	}
+	t.certificate.Store(&certificate)
+	return nil
+}
+
+// rotateTicketKeys adds a new session ticket key, the first key is used to
+// encrypt new tickets and the rest are only used for decrypting
+func (t *tlsConfigs) rotateTicketKeys() error {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return fmt.Errorf("generating session ticket key: %v", err)
+	}
+	t.ticketKeys = append([][32]byte{key}, t.ticketKeys...)
+	if len(t.ticketKeys) > ticketKeyHistory {
+		t.ticketKeys = t.ticketKeys[:ticketKeyHistory]
+	}
+	t.server.SetSessionTicketKeys(t.ticketKeys)
+	return nil
+}
+
+// CertificateInfo describes a certificate in the chain we present to peers
+type CertificateInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SANs      []string  `json:"sans,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn string    `json:"expires_in"`
+	CA        bool      `json:"ca,omitempty"`
+}
+
+// CertificateChain returns the chain in use followed by the CA in certs
+func (c *Config) CertificateChain(certs *Certs) ([]CertificateInfo, error) {
+	t, err := c.tlsConfigs()
+	if err != nil {
+		return nil, err
+	}
+	ders := t.certificate.Load().Certificate
+	ca, _ := pem.Decode(certs.ca)
+	if ca != nil {
+		ders = append(ders[:len(ders):len(ders)], ca.Bytes)
+	}
+	var chain []CertificateInfo
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %v", err)
+		}
+		chain = append(chain, CertificateInfo{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			SANs:      certificateSANs(cert),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			ExpiresIn: time.Until(cert.NotAfter).Round(time.Second).String(),
+			CA:        cert.IsCA,
+		})
+	}
+	return chain, nil
+}
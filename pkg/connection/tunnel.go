@@ -0,0 +1,236 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+	"golang.org/x/net/http2"
+)
+
+// Tunnel mode keeps a single long-lived mTLS HTTP/2 connection to every peer
+// proxy and carries each intercepted flow as a CONNECT stream, the original
+// destination is the authority of the request (HBONE-style). This saves us a
+// full TLS handshake for every connection an application makes.
+
+// The response header used to carry a Status back to the internal proxy
+const tunnelStatusHeader = "Smesh-Status"
+
+// The request header used to carry the port the application connected from
+const tunnelSourcePortHeader = "Smesh-Source-Port"
+
+// The request headers used to carry the access log connection ID and the pod
+// the application runs in
+const (
+	tunnelConnectionHeader = "Smesh-Connection-Id"
+	tunnelSourcePodHeader  = "Smesh-Source-Pod"
+)
+
+var tunnel struct {
+	once      sync.Once
+	transport *http2.Transport
+	server    *http2.Server
+}
+
+// tunnelTransport returns the shared HTTP/2 transport, it pools connections
+// per peer proxy so subsequent streams reuse the existing TLS session
+func (c *Config) tunnelTransport() *http2.Transport {
+	tunnel.once.Do(func() {
+		tunnel.transport = &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				config, err := c.clientTLSConfig()
+				if err != nil {
+					return nil, err
+				}
+				config = config.Clone()
+				config.NextProtos = []string{http2.NextProtoTLS}
+				return c.dialTLS(ctx, addr, config)
+			},
+			ReadIdleTimeout: 30 * time.Second,
+			PingTimeout:     10 * time.Second,
+		}
+		tunnel.server = &http2.Server{}
+	})
+	return tunnel.transport
+}
+
+// tunnelProxy carries the application connection to the remote proxy as a
+// CONNECT stream
+func (c *Config) tunnelProxy(conn net.Conn, endpoint string, record *AccessRecord) {
+	targetDestination := record.Destination
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: endpoint},
+		Host:   targetDestination,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	if source, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.Header.Set(tunnelSourcePortHeader, strconv.Itoa(source.Port))
+	}
+	req.Header.Set(tunnelConnectionHeader, record.ID)
+	if c.PodName != "" {
+		req.Header.Set(tunnelSourcePodHeader, c.PodName)
+	}
+
+	start := time.Now()
+	resp, err := c.tunnelTransport().RoundTrip(req)
+	if err == nil {
+		record.setTLS(resp.TLS)
+	}
+	observeDial(dialRemoteProxyTarget, start, err)
+	if err != nil {
+		slog.Printf("Failed to open tunnel to %s: %v", endpoint, err)
+		pw.Close()
+		rejectConnection(conn, record, StatusFromError(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		status := StatusFailure
+		s, err := strconv.ParseUint(resp.Header.Get(tunnelStatusHeader), 10, 8)
+		if err == nil {
+			status = Status(s)
+		}
+		rejectConnection(conn, record, status)
+		return
+	}
+
+	slog.Printf("tunnel to proxy %s, original %s", endpoint, targetDestination)
+
+	result := Pipe(conn, &clientStream{r: resp.Body, w: pw}, c.pipeOptions(record))
+	observePipe(ListenerInternal, peerLabel(resp.TLS), result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", conn.RemoteAddr(), targetDestination, result.Reason, result.Upstream, result.Downstream)
+}
+
+// serveTunnel handles a TLS connection from a peer proxy that negotiated h2
+func (c *Config) serveTunnel(conn *tls.Conn) {
+	c.tunnelTransport()
+	tunnel.server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(c.handleTunnelStream),
+	})
+}
+
+// handleTunnelStream connects a single CONNECT stream to its original destination
+func (c *Config) handleTunnelStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	remoteAddress := r.Host
+	if c.isProxyAddress(remoteAddress) {
+		slog.Printf("Potential loopback from %s", r.RemoteAddr)
+		tunnelError(w, StatusLoopDetected)
+		return
+	}
+
+	sourcePort, _ := strconv.ParseUint(r.Header.Get(tunnelSourcePortHeader), 10, 16)
+	source := sourceAddress(r.RemoteAddr, uint16(sourcePort))
+	record := c.newAccessRecord(ListenerTLS, r.Header.Get(tunnelConnectionHeader), source, remoteAddress)
+	record.SourcePod = r.Header.Get(tunnelSourcePodHeader)
+	record.DestinationPod = c.PodName
+	record.setTLS(r.TLS)
+	defer c.closeAccessRecord(record)
+
+	peer := peerLabel(r.TLS)
+	start := time.Now()
+	targetConn, err := c.dial("tcp", remoteAddress, 5*time.Second)
+	observeDial(dialApplicationTarget, start, err)
+	if err != nil {
+		slog.Printf("Failed to connect to original destination[%s]: %v", remoteAddress, err)
+		record.reject(StatusFromError(err))
+		tunnelError(w, StatusFromError(err))
+		return
+	}
+	defer targetConn.Close()
+
+	err = c.sendProxyProtocol(targetConn, source, targetConn.RemoteAddr().(*net.TCPAddr), r.TLS)
+	if err != nil {
+		slog.Printf("Failed to send proxy protocol header to [%s]: %v", remoteAddress, err)
+		record.reject(StatusFailure)
+		tunnelError(w, StatusFailure)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Printf("Tunnel stream from %s doesn't support flushing", r.RemoteAddr)
+		return
+	}
+	flusher.Flush()
+
+	slog.Printf("%s -> %s (tunnel)", r.RemoteAddr, targetConn.RemoteAddr())
+
+	stream := &serverStream{r: r.Body, w: flushWriter{w: w, f: flusher}}
+	result := Pipe(stream, targetConn, c.pipeOptions(record))
+	observePipe(ListenerTLS, peer, result)
+	record.finish(result)
+	slog.Printf("%s -> %s closed [%s] sent %d received %d", r.RemoteAddr, remoteAddress, result.Reason, result.Upstream, result.Downstream)
+}
+
+// tunnelError maps a Status onto the closest HTTP error for the stream
+func tunnelError(w http.ResponseWriter, status Status) {
+	w.Header().Set(tunnelStatusHeader, strconv.Itoa(int(status)))
+	code := http.StatusBadGateway
+	switch status {
+	case StatusTimeout:
+		code = http.StatusGatewayTimeout
+	case StatusPolicyDenied:
+		code = http.StatusForbidden
+	case StatusLoopDetected:
+		code = http.StatusLoopDetected
+	}
+	http.Error(w, fmt.Sprintf("unable to connect: %s", status), code)
+}
+
+// flushWriter flushes every write so the stream behaves like a socket
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+// clientStream is the internal proxy side of a CONNECT stream, closing the
+// write side ends the request body
+type clientStream struct {
+	r io.ReadCloser
+	w *io.PipeWriter
+}
+
+func (s *clientStream) Read(b []byte) (int, error)  { return s.r.Read(b) }
+func (s *clientStream) Write(b []byte) (int, error) { return s.w.Write(b) }
+func (s *clientStream) CloseWrite() error           { return s.w.Close() }
+
+func (s *clientStream) Close() error {
+	s.w.Close()
+	return s.r.Close()
+}
+
+// serverStream is the remote proxy side of a CONNECT stream, the response can
+// only be ended by returning from the handler so it can't be half-closed
+type serverStream struct {
+	r io.ReadCloser
+	w io.Writer
+}
+
+func (s *serverStream) Read(b []byte) (int, error)  { return s.r.Read(b) }
+func (s *serverStream) Write(b []byte) (int, error) { return s.w.Write(b) }
+func (s *serverStream) Close() error                { return s.r.Close() }
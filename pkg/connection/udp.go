@@ -0,0 +1,444 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/gookit/slog"
+)
+
+// UDP datagrams that the eBPF redirects to the relay are carried over a
+// connection to the remote proxy per flow (application socket and original
+// destination). Each datagram is framed with a 2 byte length.
+//
+// A connected socket only has one destination, its datagrams all arrive on the
+// relay's port and the replies are sent from it. An unconnected socket can send
+// to several destinations, so the first datagram of each flow arrives on the
+// relay's port and the relay opens a socket for the flow. Its port is
+// registered in map_udp_flows, so the rest of the flow's datagrams are sent
+// straight to it, and in map_udp_replies, so the eBPF can make the replies
+// look like they came from the original destination.
+//
+// Setting a flow up means a handshake with the remote proxy, so it happens off
+// the relay's read loop and the datagrams that arrive in the meantime are
+// queued (or dropped once udpFlowQueue are waiting).
+
+// How long a UDP flow can be idle before the relay forgets about it
+const udpFlowTimeout = time.Minute
+
+// How long the cookie found for a source address is trusted, a new socket can
+// be bound to the same port once the old one is closed
+const udpCookieTTL = 10 * time.Second
+
+// The largest datagram we relay
+const maxDatagramSize = 65535
+
+// How many datagrams a flow queues before the remote proxy catches up
+const udpFlowQueue = 64
+
+// udpDestination matches struct Destination in the eBPF
+type udpDestination struct {
+	Addr      uint32
+	Port      uint16
+	Connected uint8
+	_         [1]byte
+	Time      uint64
+}
+
+// udpFlowKey matches struct UDPFlow in the eBPF
+type udpFlowKey struct {
+	Cookie uint64
+	Addr   uint32
+	Port   uint16
+	_      [2]byte
+}
+
+type udpFlow struct {
+	key       udpFlowKey
+	connected bool
+	remote    net.Conn     // connection to the remote proxy
+	reply     *net.UDPConn // socket the replies are sent to the application from
+	idle      *udpIdle
+	datagrams chan []byte   // read by the relay, waiting to go to the remote proxy
+	done      chan struct{} // closed once the flow has finished
+}
+
+// queue hands a datagram to the flow without blocking the relay
+func (f *udpFlow) queue(b []byte) bool {
+	select {
+	case f.datagrams <- append([]byte(nil), b...):
+		return true
+	default:
+		return false
+	}
+}
+
+type udpCookie struct {
+	cookie  uint64
+	expires time.Time
+}
+
+// udpCookies caches the socket cookie for each source address, finding it
+// means dumping every UDP socket
+var udpCookies sync.Map
+
+func (c *Config) StartUDPListener() *net.UDPConn {
+	proxyAddr := fmt.Sprintf("%s:%d", c.Address, c.UDPPort)
+	addr, err := net.ResolveUDPAddr("udp", proxyAddr)
+	if err != nil {
+		slog.Fatalf("Failed to resolve UDP relay address: %v", err)
+	}
+	listener, err := c.listenUDP(ListenerUDP, addr)
+	if err != nil {
+		slog.Fatalf("Failed to start UDP relay: %v", err)
+	}
+	slog.Infof("[pid: %d] %s (udp)", os.Getpid(), proxyAddr)
+	return listener
+}
+
+// Blocking function
+func (c *Config) StartUDPRelay(listener *net.UDPConn) {
+	var flows sync.Map
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, source, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Printf("Failed to read datagram: %v", err)
+			continue
+		}
+		cookie, destination, connected, err := c.udpOriginalDestination(source)
+		if err != nil {
+			slog.Printf("Failed to find original destination for %s: %v", source, err)
+			continue
+		}
+
+		key := udpFlowKey{
+			Cookie: cookie,
+			Addr:   binary.BigEndian.Uint32(destination.IP.To4()),
+			Port:   uint16(destination.Port),
+		}
+		f, ok := flows.Load(key)
+		if !ok {
+			flow := &udpFlow{
+				key:       key,
+				connected: connected,
+				datagrams: make(chan []byte, udpFlowQueue),
+				done:      make(chan struct{}),
+			}
+			flows.Store(key, flow)
+			c.track(ListenerUDP, func() {
+				defer flows.Delete(key)
+				defer close(flow.done)
+				err := c.setupUDPFlow(listener, flow, source, destination)
+				if err != nil {
+					slog.Printf("Failed to relay %s -> %s: %v", source, destination, err)
+					return
+				}
+				go c.sendDatagrams(flow, source, destination)
+				c.relayReplies(flow, source, destination)
+			})
+			f = flow
+		}
+		if !f.(*udpFlow).queue(buf[:n]) {
+			slog.Debugf("Dropped datagram %s -> %s, the flow isn't keeping up", source, destination)
+		}
+	}
+}
+
+// udpOriginalDestination looks up where the application actually sent the
+// datagram, using the cookie of the sending socket
+func (c *Config) udpOriginalDestination(source *net.UDPAddr) (uint64, *net.UDPAddr, bool, error) {
+	if c.UDPSocks == nil {
+		return 0, nil, false, fmt.Errorf("no UDP socket map")
+	}
+	key := source.String()
+	var cookie uint64
+	if cached, ok := udpCookies.Load(key); ok && time.Now().Before(cached.(udpCookie).expires) {
+		cookie = cached.(udpCookie).cookie
+	} else {
+		var err error
+		cookie, err = udpSocketCookie(source)
+		if err != nil {
+			udpCookies.Delete(key)
+			return 0, nil, false, err
+		}
+		udpCookies.Store(key, udpCookie{cookie: cookie, expires: time.Now().Add(udpCookieTTL)})
+	}
+	var dst udpDestination
+	err := c.UDPSocks.Lookup(&cookie, &dst)
+	if err != nil {
+		udpCookies.Delete(key)
+		return 0, nil, false, fmt.Errorf("looking up socket cookie %d: %v", cookie, err)
+	}
+	// Let the eBPF know the first datagram has been read, the socket can send
+	// to another destination now
+	if dst.Connected == 0 && dst.Time != 0 {
+		claimed := dst
+		claimed.Time = 0
+		c.UDPSocks.Update(&cookie, &claimed, ebpf.UpdateExist)
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, dst.Addr)
+	return cookie, &net.UDPAddr{IP: ip, Port: int(dst.Port)}, dst.Connected != 0, nil
+}
+
+// setupUDPFlow connects to the remote proxy for the destination, a flow from
+// an unconnected socket gets its own relay socket which is registered with the
+// eBPF
+func (c *Config) setupUDPFlow(listener *net.UDPConn, flow *udpFlow, source, destination *net.UDPAddr) error {
+	remote, err := c.dialRemoteProxy(c.remoteEndpoint(destination.IP.String()))
+	if err != nil {
+		return err
+	}
+	header, err := NewHeader(destination.IP.String(), uint16(destination.Port))
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	header.SetSourcePort(uint16(source.Port))
+	header.Metadata = append(header.Metadata, TLV{Type: TLVDatagram})
+	reply, err := handshakeRemoteProxy(remote, header)
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	if reply.Status != StatusOK {
+		remote.Close()
+		return fmt.Errorf("remote proxy returned [%s]", reply.Status)
+	}
+
+	flow.remote = remote
+	flow.reply = listener
+	if flow.connected {
+		flow.idle = newUDPIdle(func() { remote.Close() })
+		return nil
+	}
+
+	replyConn, err := c.listenUDPMarked(&net.UDPAddr{IP: net.ParseIP(c.Address)})
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	replyPort := uint16(replyConn.LocalAddr().(*net.UDPAddr).Port)
+	dst := udpDestination{Addr: flow.key.Addr, Port: flow.key.Port}
+	err = c.UDPReplies.Update(&replyPort, &dst, ebpf.UpdateAny)
+	if err == nil && c.UDPFlows != nil {
+		err = c.UDPFlows.Update(&flow.key, &replyPort, ebpf.UpdateAny)
+	}
+	if err != nil {
+		c.UDPReplies.Delete(&replyPort)
+		remote.Close()
+		replyConn.Close()
+		return fmt.Errorf("registering relay port %d: %v", replyPort, err)
+	}
+	flow.reply = replyConn
+	flow.idle = newUDPIdle(func() {
+		remote.Close()
+		replyConn.Close()
+	})
+	return nil
+}
+
+// relayReplies sends datagrams from the remote proxy back to the application
+// until the flow has been idle for udpFlowTimeout
+func (c *Config) relayReplies(flow *udpFlow, source, destination *net.UDPAddr) {
+	defer func() {
+		flow.idle.stop()
+		flow.remote.Close()
+		if flow.connected {
+			return
+		}
+		replyPort := uint16(flow.reply.LocalAddr().(*net.UDPAddr).Port)
+		c.UDPFlows.Delete(&flow.key)
+		c.UDPReplies.Delete(&replyPort)
+		flow.reply.Close()
+	}()
+	if !flow.connected {
+		go c.relayFlow(flow, source, destination)
+	}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(flow.remote, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Printf("Failed to read datagram from remote proxy for %s: %v", destination, err)
+			}
+			return
+		}
+		flow.idle.touch()
+		_, err = flow.reply.WriteToUDP(buf[:n], source)
+		if err != nil {
+			slog.Printf("Failed to send datagram to %s: %v", source, err)
+		}
+	}
+}
+
+// sendDatagrams sends the datagrams the relay queued for the flow to the
+// remote proxy
+func (c *Config) sendDatagrams(flow *udpFlow, source, destination *net.UDPAddr) {
+	for {
+		select {
+		case <-flow.done:
+			return
+		case b := <-flow.datagrams:
+			flow.idle.touch()
+			err := writeDatagram(flow.remote, b)
+			if err != nil {
+				slog.Printf("Failed to relay datagram %s -> %s: %v", source, destination, err)
+			}
+		}
+	}
+}
+
+// relayFlow sends the datagrams the eBPF redirects to the flow's own socket to
+// the remote proxy
+func (c *Config) relayFlow(flow *udpFlow, source, destination *net.UDPAddr) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := flow.reply.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Printf("Failed to read datagram for %s: %v", destination, err)
+			}
+			flow.remote.Close()
+			return
+		}
+		if from.Port != source.Port {
+			continue
+		}
+		flow.idle.touch()
+		err = writeDatagram(flow.remote, buf[:n])
+		if err != nil {
+			slog.Printf("Failed to relay datagram %s -> %s: %v", source, destination, err)
+		}
+	}
+}
+
+// handleUDPRelay is the remote proxy side of a UDP flow, conn has already
+// sent the header
+func (c *Config) handleUDPRelay(conn net.Conn, header *Header) {
+	remoteAddress := header.Address()
+	targetConn, err := c.dial("udp", remoteAddress, 5*time.Second)
+	if err != nil {
+		slog.Printf("Failed to connect to original destination[%s]: %v", remoteAddress, err)
+		WriteReply(conn, header, StatusFromError(err))
+		return
+	}
+	defer targetConn.Close()
+	err = WriteReply(conn, header, StatusOK)
+	if err != nil {
+		slog.Printf("Failed to send reply: %v", err)
+		return
+	}
+	slog.Printf("%s -> %s (udp)", conn.RemoteAddr(), remoteAddress)
+
+	idle := newUDPIdle(func() {
+		conn.Close()
+		targetConn.Close()
+	})
+	defer idle.stop()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := targetConn.Read(buf)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			idle.touch()
+			err = writeDatagram(conn, buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(conn, buf)
+		if err != nil {
+			return
+		}
+		idle.touch()
+		_, err = targetConn.Write(buf[:n])
+		if err != nil {
+			slog.Printf("Failed to send datagram to %s: %v", remoteAddress, err)
+		}
+	}
+}
+
+// udpIdle closes a flow once no datagram has gone in either direction for
+// udpFlowTimeout
+type udpIdle struct {
+	last atomic.Int64
+	done chan struct{}
+}
+
+func newUDPIdle(expire func()) *udpIdle {
+	i := &udpIdle{done: make(chan struct{})}
+	i.touch()
+	go func() {
+		timer := time.NewTimer(udpFlowTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-i.done:
+				return
+			case <-timer.C:
+			}
+			idle := time.Since(time.Unix(0, i.last.Load()))
+			if idle >= udpFlowTimeout {
+				expire()
+				return
+			}
+			timer.Reset(udpFlowTimeout - idle)
+		}
+	}()
+	return i
+}
+
+// touch records a datagram
+func (i *udpIdle) touch() {
+	i.last.Store(time.Now().UnixNano())
+}
+
+// stop must be called once the flow has finished
+func (i *udpIdle) stop() {
+	close(i.done)
+}
+
+func writeDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("datagram too large [%d]", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram too large [%d]", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
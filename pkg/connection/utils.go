@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"os"
@@ -23,6 +24,15 @@ type SockAddrIn struct {
 	Pad [8]byte
 }
 
+// SockAddrIn6 is the sockaddr_in6 structure for IPv6 "retrieved" by IP6T_SO_ORIGINAL_DST.
+type SockAddrIn6 struct {
+	SinFamily   uint16
+	SinPort     [2]byte
+	SinFlowInfo uint32
+	SinAddr     [16]byte
+	SinScopeID  uint32
+}
+
 type Certs struct {
 	ca   []byte
 	key  []byte
@@ -47,7 +57,35 @@ func ToInt(address string) int {
 	return i
 }
 
+// ToWords6 converts an IPv6 address to the four words the eBPF uses, the bytes
+// stay in network order
+func ToWords6(address string) [4]uint32 {
+	var words [4]uint32
+	ip := net.ParseIP(address).To16()
+	if ip == nil {
+		return words
+	}
+	for i := range words {
+		words[i] = binary.NativeEndian.Uint32(ip[i*4:])
+	}
+	return words
+}
+
+// isIPv6 checks if the connection is using an IPv6 socket (not IPv4-mapped)
+func isIPv6(conn net.Conn) bool {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
 func (c *Config) findTargetFromConnection(conn net.Conn) (targetAddr string, targetPort uint16, err error) {
+	// The eBPF maps give us the full original socket, if that doesn't work
+	// then fall back to SO_ORIGINAL_DST
+	sock, lookupErr := c.LookupSocket(conn)
+	if lookupErr == nil {
+		return sock.Destination.IP.String(), uint16(sock.Destination.Port), nil
+	}
+	slog.Debugf("Socket lookup failed, using SO_ORIGINAL_DST: %v", lookupErr)
+
 	// Using RawConn is necessary to perform low-level operations on the underlying socket file descriptor in Go.
 	// This allows us to use getsockopt to retrieve the original destination address set by the SO_ORIGINAL_DST option,
 	// which isn't directly accessible through Go's higher-level networking API.
@@ -57,8 +95,11 @@ func (c *Config) findTargetFromConnection(conn net.Conn) (targetAddr string, tar
 		return
 	}
 
+	if isIPv6(conn) {
+		return findTargetFromConnection6(rawConn)
+	}
+
 	var originalDst SockAddrIn
-	// var cookie uint64
 	// If Control is not nil, it is called after creating the network connection but before binding it to the operating system.
 	rawConn.Control(func(fd uintptr) {
 		optlen := uint32(unsafe.Sizeof(originalDst))
@@ -68,36 +109,30 @@ func (c *Config) findTargetFromConnection(conn net.Conn) (targetAddr string, tar
 			slog.Printf("getsockopt SO_ORIGINAL_DST failed: %v", err)
 			return
 		}
-		// cookie, err = unix.GetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_COOKIE)
-		// if err != nil {
-		// 	slog.Printf("getsockopt SOL_SOCKET failed: %v", err)
-		// }
 	})
-	// slog.Info("🍪 %d", cookie)
-	// i := c.Socks.Iterate()
-	// var key uint32
-	// var value mirrorsSocket
-	// for i.Next(&key, &value) {
-	// 	// Order of keys is non-deterministic due to randomized map seed
-	// 	slog.Infof("%d %v", key, value)
-	// }
-
-	// // if err != nil || err2 != nil {
-	// // 	return
-	// // }
-	// // slog.Infof("Cookies %d", cookie)
-	// var m mirrorsSocket
-	// err = c.Socks.Lookup(uint32(cookie), &m)
-	// if err != nil {
-	// 	slog.Error(err)
-	// } else {
-	// 	fmt.Printf("%v", m)
-	// }
 	targetAddr = net.IPv4(originalDst.SinAddr[0], originalDst.SinAddr[1], originalDst.SinAddr[2], originalDst.SinAddr[3]).String()
 	targetPort = (uint16(originalDst.SinPort[0]) << 8) | uint16(originalDst.SinPort[1])
 	return
 }
 
+// findTargetFromConnection6 is the IPv6 version of findTargetFromConnection
+func findTargetFromConnection6(rawConn syscall.RawConn) (targetAddr string, targetPort uint16, err error) {
+	var originalDst SockAddrIn6
+	rawConn.Control(func(fd uintptr) {
+		optlen := uint32(unsafe.Sizeof(originalDst))
+		err = getsockopt(int(fd), syscall.SOL_IPV6, SO_ORIGINAL_DST, unsafe.Pointer(&originalDst), &optlen)
+		if err != nil {
+			slog.Printf("getsockopt IP6T_SO_ORIGINAL_DST failed: %v", err)
+		}
+	})
+	if err != nil {
+		return
+	}
+	targetAddr = net.IP(originalDst.SinAddr[:]).String()
+	targetPort = (uint16(originalDst.SinPort[0]) << 8) | uint16(originalDst.SinPort[1])
+	return
+}
+
 func GetEnvCerts() (*Certs, error) {
 	envca, exists := os.LookupEnv("SMESH-CA")
 	if !exists {
@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"smesh/pkg/connection"
+	"strconv"
+
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// The admin API is for an operator debugging a pod, so it only listens on
+// localhost by default. Everything is read-only JSON apart from pprof.
+
+// tupleRecord matches struct Tuple in the eBPF
+type tupleRecord struct {
+	Family  uint32
+	SrcAddr [16]byte
+	DstAddr [16]byte
+	SrcPort uint16
+	DstPort uint16
+}
+
+// address returns the tuple's source or destination address
+func (t tupleRecord) address(addr [16]byte, port uint16) string {
+	ip := net.IP(addr[:])
+	if t.Family == unix.AF_INET {
+		ip = ip[:net.IPv4len]
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+type socketEntry struct {
+	Cookie      uint64 `json:"cookie"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type portEntry struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Cookie      uint64 `json:"cookie"`
+}
+
+type ebpfState struct {
+	Sockets       []socketEntry         `json:"map_socks"`
+	Ports         []portEntry           `json:"map_ports"`
+	Compatibility []*Feature            `json:"compatibility"`
+	Disabled      []string              `json:"disabled_programs,omitempty"`
+	Maps          map[string]mapSummary `json:"maps"`
+}
+
+type mapSummary struct {
+	Entries    int    `json:"entries"`
+	MaxEntries uint32 `json:"max_entries"`
+}
+
+// writeJSON sends v as indented JSON
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		slog.Errorf("admin: encoding response: %v", err)
+	}
+}
+
+// readEBPF dumps the connection maps
+func readEBPF(c *connection.Config) (*ebpfState, error) {
+	state := &ebpfState{
+		Sockets:       []socketEntry{},
+		Ports:         []portEntry{},
+		Compatibility: Compatibility,
+		Maps:          map[string]mapSummary{},
+	}
+	sockets, err := c.Sockets()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sockets {
+		state.Sockets = append(state.Sockets, socketEntry{
+			Cookie:      s.Cookie,
+			Source:      s.Source.String(),
+			Destination: s.Destination.String(),
+		})
+	}
+	if m := tracker.objs.MapPorts; m != nil {
+		var tuple tupleRecord
+		var cookie uint64
+		entries := m.Iterate()
+		for entries.Next(&tuple, &cookie) {
+			state.Ports = append(state.Ports, portEntry{
+				Source:      tuple.address(tuple.SrcAddr, tuple.SrcPort),
+				Destination: tuple.address(tuple.DstAddr, tuple.DstPort),
+				Cookie:      cookie,
+			})
+		}
+		if err := entries.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for name, m := range trackedMaps() {
+		if m == nil {
+			continue
+		}
+		count, err := countEntries(m)
+		if err != nil {
+			continue
+		}
+		state.Maps[name] = mapSummary{Entries: count, MaxEntries: m.MaxEntries()}
+	}
+	for name := range tracker.disabled {
+		state.Disabled = append(state.Disabled, name)
+	}
+	return state, nil
+}
+
+// adminHandler builds the admin API for c
+func adminHandler(c *connection.Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.ActiveConnections())
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := c.Snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, snapshot)
+	})
+	mux.HandleFunc("GET /certs", func(w http.ResponseWriter, r *http.Request) {
+		certs := c.LoadedCertificates()
+		if certs == nil {
+			http.Error(w, "no certificates loaded", http.StatusNotFound)
+			return
+		}
+		chain, err := c.CertificateChain(certs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, chain)
+	})
+	mux.HandleFunc("GET /ebpf", func(w http.ResponseWriter, r *http.Request) {
+		state, err := readEBPF(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, state)
+	})
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", serveReadyz)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startAdminServer serves the admin API on address until ctx is done
+func startAdminServer(ctx context.Context, c *connection.Config, address string) {
+	server := &http.Server{Addr: address, Handler: adminHandler(c)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Infof("admin endpoint http://%s/", address)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("admin endpoint failed: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"smesh/pkg/connection"
+	"strings"
+
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Attaching to the root cgroup intercepts every process on the node (kubelet,
+// the api-server...), so by default we find the cgroup of the pod we're running
+// in and only attach there.
+
+// Matches the pod level cgroup for both the cgroupfs (pod<uid>) and systemd
+// (kubepods-burstable-pod<uid>.slice) drivers
+var podCgroupPattern = regexp.MustCompile(`(^|-)pod[0-9a-f_-]+(\.slice)?$`)
+
+const defaultCgroupMount = "/sys/fs/cgroup"
+
+// resolveCgroup returns the cgroup to attach the eBPF programs to
+func resolveCgroup(c *connection.Config) (string, error) {
+	mount := cgroup2Mount()
+	path := c.CgroupOverride
+	if path == "" {
+		var err error
+		path, err = discoverPodCgroup(mount, c.HostCgroup)
+		if err != nil {
+			return "", fmt.Errorf("unable to find the pod cgroup (set -cgroupPath): %v", err)
+		}
+		slog.Infof("discovered pod cgroup %s", path)
+	}
+	for _, root := range []string{mount, c.HostCgroup} {
+		if root != "" && filepath.Clean(path) == filepath.Clean(root) && !c.ForceRootCgroup {
+			return "", fmt.Errorf("refusing to attach to the root cgroup %s, this intercepts the whole node (use -forceRootCgroup)", path)
+		}
+	}
+	return path, nil
+}
+
+// discoverPodCgroup finds the pod level cgroup above ours. With a private
+// cgroup namespace (the default with cgroup v2) /proc/self/cgroup only shows
+// "/", so our cgroup is found in the node's hierarchy at hostMount by its
+// inode and the pod is the first parent that looks like one. Without the host
+// mount the path from /proc/self/cgroup is only usable if it is the node's.
+func discoverPodCgroup(mount, hostMount string) (string, error) {
+	self, err := selfCgroup()
+	if err != nil {
+		return "", err
+	}
+	if hostMount != "" && isCgroup2(hostMount) {
+		var own unix.Stat_t
+		err = unix.Stat(filepath.Join(mount, self), &own)
+		if err != nil {
+			return "", fmt.Errorf("unable to stat our cgroup: %v", err)
+		}
+		hostPath, err := findCgroup(hostMount, own)
+		if err != nil {
+			return "", err
+		}
+		if pod := podCgroup(hostPath); pod != "" {
+			return filepath.Join(hostMount, pod), nil
+		}
+		return "", fmt.Errorf("no pod cgroup above [%s] in %s", hostPath, hostMount)
+	}
+	if pod := podCgroup(self); pod != "" {
+		return filepath.Join(mount, pod), nil
+	}
+	// A private cgroup namespace shows us as "/", the pod isn't visible
+	return "", fmt.Errorf("no pod cgroup above [%s] and the node's cgroups aren't mounted at [%s]", self, hostMount)
+}
+
+// selfCgroup reads our cgroup v2 path from /proc/self/cgroup, it is relative
+// to our cgroup namespace
+func selfCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// cgroup v2 is the "0::<path>" entry
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+// podCgroup walks up path to the pod level cgroup, or returns ""
+func podCgroup(path string) string {
+	for dir := path; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if podCgroupPattern.MatchString(filepath.Base(dir)) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// isCgroup2 checks that path is a cgroup v2 mount
+func isCgroup2(path string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(path, &st) == nil && st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// findCgroup walks the hierarchy at root for the cgroup with the same inode as
+// own, and returns its path relative to root
+func findCgroup(root string, own unix.Stat_t) (string, error) {
+	var found string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			// Cgroups can disappear while we walk
+			return nil
+		}
+		var st unix.Stat_t
+		if unix.Stat(path, &st) != nil {
+			return nil
+		}
+		if st.Ino == own.Ino && st.Dev == own.Dev {
+			found = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("our cgroup isn't in %s", root)
+	}
+	rel, err := filepath.Rel(root, found)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/", rel), nil
+}
+
+// cgroup2Mount finds where the cgroup v2 hierarchy is mounted
+func cgroup2Mount() string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return defaultCgroupMount
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The filesystem type follows the " - " separator
+		fields, after, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok || !strings.HasPrefix(after, "cgroup2 ") {
+			continue
+		}
+		mountFields := strings.Fields(fields)
+		if len(mountFields) > 4 {
+			return mountFields[4]
+		}
+	}
+	return defaultCgroupMount
+}
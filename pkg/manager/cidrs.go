@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"smesh/pkg/connection"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/gookit/slog"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// The eBPF only intercepts destinations whose longest matching prefix in
+// map_cidrs (or map_cidrs6) is an include. The prefixes come from the flags,
+// an optional file and optionally Kubernetes, and are kept up to date without
+// reloading the programs.
+
+// These match CIDR_INCLUDE and CIDR_EXCLUDE in the eBPF
+const (
+	cidrInclude uint8 = 1
+	cidrExclude uint8 = 2
+)
+
+// cidrKey4 matches struct CIDR4 in the eBPF
+type cidrKey4 struct {
+	PrefixLen uint32
+	Addr      [4]byte
+}
+
+// cidrKey6 matches struct CIDR6 in the eBPF
+type cidrKey6 struct {
+	PrefixLen uint32
+	Addr      [16]byte
+}
+
+// cidrFile is the format of the -cidrFile
+type cidrFile struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// parseCIDRs parses a list of (possibly comma separated) CIDRs into the
+// prefixes map with the given action, excludes win over includes
+func parseCIDRs(prefixes map[netip.Prefix]uint8, action uint8, cidrs ...string) error {
+	for _, list := range cidrs {
+		for _, cidr := range strings.Split(list, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("error parsing cidr %s: %v", cidr, err)
+			}
+			prefix = prefix.Masked()
+			if prefixes[prefix] != cidrExclude {
+				prefixes[prefix] = action
+			}
+		}
+	}
+	return nil
+}
+
+// desiredCIDRs gathers the prefixes from every configured source
+func desiredCIDRs(c *connection.Config) (map[netip.Prefix]uint8, error) {
+	prefixes := map[netip.Prefix]uint8{}
+	err := parseCIDRs(prefixes, cidrExclude, c.ExcludeCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	err = parseCIDRs(prefixes, cidrInclude, c.PodCIDR, c.PodCIDR6)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.CIDRFile != "" {
+		b, err := os.ReadFile(c.CIDRFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cidr file [%v]", err)
+		}
+		var f cidrFile
+		err = yaml.Unmarshal(b, &f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse cidr file [%v]", err)
+		}
+		err = parseCIDRs(prefixes, cidrExclude, f.Exclude...)
+		if err != nil {
+			return nil, err
+		}
+		err = parseCIDRs(prefixes, cidrInclude, f.Include...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.KubeCIDRs {
+		kubeCIDRs, err := getKubeCIDRs(c)
+		if err != nil {
+			return nil, err
+		}
+		err = parseCIDRs(prefixes, cidrInclude, kubeCIDRs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prefixes, nil
+}
+
+// getKubeCIDRs returns the pod CIDRs of every node and the service CIDRs
+func getKubeCIDRs(c *connection.Config) ([]string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load in-cluster config: %v", err)
+	}
+	// Don't intercept our own connections to the api-server
+	config.Dial = c.DialContext
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var cidrs []string
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes [%v]", err)
+	}
+	for _, node := range nodes.Items {
+		cidrs = append(cidrs, node.Spec.PodCIDRs...)
+	}
+	// ServiceCIDRs are beta, older clusters won't have them
+	serviceCIDRs, err := client.NetworkingV1beta1().ServiceCIDRs().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		slog.Debugf("unable to list service cidrs: %v", err)
+	} else {
+		for _, serviceCIDR := range serviceCIDRs.Items {
+			cidrs = append(cidrs, serviceCIDR.Spec.CIDRs...)
+		}
+	}
+	return cidrs, nil
+}
+
+// ipv6Skipped only warns about the IPv6 cidrs the first time, they are
+// dropped again on every refresh
+var ipv6Skipped sync.Once
+
+// SyncCIDRs makes the eBPF prefix maps match the configured sources
+func SyncCIDRs(c *connection.Config) error {
+	prefixes, err := desiredCIDRs(c)
+	if err != nil {
+		return err
+	}
+	desired4 := map[cidrKey4]uint8{}
+	desired6 := map[cidrKey6]uint8{}
+	skipped := 0
+	for prefix, action := range prefixes {
+		if prefix.Addr().Is4() {
+			desired4[cidrKey4{PrefixLen: uint32(prefix.Bits()), Addr: prefix.Addr().As4()}] = action
+			continue
+		}
+		// Without -podCIDR6 there is no IPv6 listener to redirect to
+		if c.PodCIDR6 == "" && action == cidrInclude {
+			skipped++
+			continue
+		}
+		desired6[cidrKey6{PrefixLen: uint32(prefix.Bits()), Addr: prefix.Addr().As16()}] = action
+	}
+	if skipped > 0 {
+		ipv6Skipped.Do(func() {
+			slog.Warnf("ignoring %d IPv6 cidrs, IPv6 interception is disabled", skipped)
+		})
+	}
+	err = syncMap(tracker.objs.MapCidrs, desired4)
+	if err != nil {
+		return err
+	}
+	return syncMap(tracker.objs.MapCidrs6, desired6)
+}
+
+// syncMap adds (or updates) the desired keys and then removes the stale ones,
+// so a prefix that is being replaced is never missing in between
+func syncMap[K comparable](m *ebpf.Map, desired map[K]uint8) error {
+	for k, v := range desired {
+		err := m.Update(&k, &v, ebpf.UpdateAny)
+		if err != nil {
+			return fmt.Errorf("adding %v to %s: %v", k, m, err)
+		}
+	}
+	var key K
+	var action uint8
+	var stale []K
+	entries := m.Iterate()
+	for entries.Next(&key, &action) {
+		if _, ok := desired[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		return fmt.Errorf("iterating %s: %v", m, err)
+	}
+	for i := range stale {
+		err := m.Delete(&stale[i])
+		if err != nil {
+			return fmt.Errorf("removing %v from %s: %v", stale[i], m, err)
+		}
+	}
+	return nil
+}
+
+// watchCIDRs re-reads the file and Kubernetes sources (and the policy file)
+// until ctx is done
+func watchCIDRs(ctx context.Context, c *connection.Config) {
+	if (c.CIDRFile == "" && !c.KubeCIDRs && c.PolicyFile == "") || c.CIDRRefresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.CIDRRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := SyncCIDRs(c)
+			if err != nil {
+				slog.Errorf("unable to update cidrs: %v", err)
+			}
+			err = SyncPolicies(c)
+			if err != nil {
+				slog.Errorf("unable to update policies: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/gookit/slog"
+)
+
+// The eBPF programs send an event into map_events (a ring buffer) whenever
+// they make a decision about a connection. These are decoded here and sent to
+// the logs, the smesh_events counters and anyone streaming /debug/events.
+
+// EventType matches the EVENT_ defines in the eBPF
+type EventType uint8
+
+const (
+	EventRedirected EventType = 1
+	EventBypassed   EventType = 2
+	EventDenied     EventType = 3
+	EventLookupHit  EventType = 4
+	EventLookupMiss EventType = 5
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRedirected:
+		return "redirected"
+	case EventBypassed:
+		return "bypassed"
+	case EventDenied:
+		return "denied"
+	case EventLookupHit:
+		return "lookup hit"
+	case EventLookupMiss:
+		return "lookup miss"
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event is a decision the eBPF made about a connection
+type Event struct {
+	Time        time.Time      `json:"time"`
+	Type        EventType      `json:"type"`
+	Cookie      uint64         `json:"cookie"`
+	PID         uint32         `json:"pid"`
+	Destination netip.AddrPort `json:"destination"`
+}
+
+// eventRecord matches struct Event in the eBPF
+type eventRecord struct {
+	Cookie uint64
+	PID    uint32
+	Family uint32
+	Addr   [16]byte
+	Port   uint16
+	Type   uint8
+	_      [5]byte
+}
+
+const afInet = 2
+
+// Streaming subscribers, slow subscribers miss events rather than slowing
+// everyone else down
+var subscribers struct {
+	sync.Mutex
+	channels map[chan Event]struct{}
+}
+
+func subscribe() chan Event {
+	ch := make(chan Event, 128)
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if subscribers.channels == nil {
+		subscribers.channels = map[chan Event]struct{}{}
+	}
+	subscribers.channels[ch] = struct{}{}
+	return ch
+}
+
+func unsubscribe(ch chan Event) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	delete(subscribers.channels, ch)
+}
+
+func publish(e Event) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for ch := range subscribers.channels {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func decodeEvent(raw []byte) (Event, error) {
+	var r eventRecord
+	err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &r)
+	if err != nil {
+		return Event{}, err
+	}
+	var addr netip.Addr
+	if r.Family == afInet {
+		addr = netip.AddrFrom4([4]byte(r.Addr[:4]))
+	} else {
+		addr = netip.AddrFrom16(r.Addr).Unmap()
+	}
+	return Event{
+		Time:        time.Now(),
+		Type:        EventType(r.Type),
+		Cookie:      r.Cookie,
+		PID:         r.PID,
+		Destination: netip.AddrPortFrom(addr, r.Port),
+	}, nil
+}
+
+// readEvents reads the ring buffer until ctx is done
+func readEvents(ctx context.Context, debug bool) {
+	// Without ring buffers map_events is a placeholder and nothing is sent
+	if tracker.objs.MapEvents == nil || tracker.objs.MapEvents.Type() != ebpf.RingBuf {
+		return
+	}
+	reader, err := ringbuf.NewReader(tracker.objs.MapEvents)
+	if err != nil {
+		slog.Errorf("unable to read eBPF events: %v", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		reader.Close()
+	}()
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			slog.Debugf("reading eBPF event: %v", err)
+			continue
+		}
+		e, err := decodeEvent(record.RawSample)
+		if err != nil {
+			slog.Debugf("decoding eBPF event: %v", err)
+			continue
+		}
+		ebpfEvents.WithLabelValues(e.Type.String()).Inc()
+		if debug {
+			slog.Infof("[%d] %s %s (cookie %d)", e.PID, e.Type, e.Destination, e.Cookie)
+		}
+		publish(e)
+	}
+}
+
+// serveEvents streams events as newline delimited JSON until the client goes
+// away
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	ch := subscribe()
+	defer unsubscribe(ch)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// startDebugServer serves the event stream on address until ctx is done
+func startDebugServer(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/events", serveEvents)
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Infof("debug endpoint http://%s/debug/events", address)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("debug endpoint failed: %v", err)
+	}
+}
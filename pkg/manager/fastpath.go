@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"smesh/pkg/connection"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/gookit/slog"
+)
+
+// With the fast path the sockops program adds both ends of every connection
+// between an application and the proxy to map_sock_hash, and the sk_msg
+// program attached to that map moves the data between them directly.
+
+// attachFastPath attaches the sk_msg program to map_sock_hash, without it the
+// fast path is turned off
+func attachFastPath(c *connection.Config) {
+	if !c.FastPath {
+		return
+	}
+	if tracker.objs.SkMsgFastPath == nil {
+		slog.Warn("the kernel can't run sk_msg programs, the fast path is disabled")
+		c.FastPath = false
+		return
+	}
+	err := link.RawAttachProgram(link.RawAttachProgramOptions{
+		Target:  tracker.objs.MapSockHash.FD(),
+		Program: tracker.objs.SkMsgFastPath,
+		Attach:  ebpf.AttachSkMsgVerdict,
+	})
+	if err != nil {
+		slog.Warnf("unable to attach sk_msg_fast_path, the fast path is disabled: %v", err)
+		c.FastPath = false
+	}
+}
@@ -0,0 +1,152 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"github.com/gookit/slog"
+)
+
+// Rather than guessing from the kernel version we ask the kernel whether it
+// supports each program type, map type and helper the eBPF uses. Programs the
+// kernel can't load are left out if we can do without them, and the result is
+// logged at startup.
+
+// Feature is something the eBPF needs from the kernel
+type Feature struct {
+	Name      string   `json:"name"`
+	Supported bool     `json:"supported"`
+	Programs  []string `json:"programs,omitempty"` // programs that can't load without it
+	Fallback  string   `json:"fallback,omitempty"` // what happens without it, empty if required
+	Error     string   `json:"error,omitempty"`
+
+	probe func() error
+}
+
+// The programs we can run without, map_events and map_sock_hash aren't
+// programs but the code that uses them is left out when they are disabled
+var optionalPrograms = map[string]string{
+	"map_events":    "eBPF events aren't reported",
+	"map_sock_hash": "traffic to the proxy goes through the loopback TCP stack",
+
+	"cg_sock_opt": "original destinations are looked up from userspace",
+	"cg_connect6": "IPv6 connections aren't intercepted",
+	"cg_sendmsg4": "UDP isn't intercepted",
+	"cg_recvmsg4": "UDP isn't intercepted",
+
+	"sk_lookup_inbound": "inbound connections aren't intercepted",
+	"sk_msg_fast_path":  "traffic to the proxy goes through the loopback TCP stack",
+}
+
+var sockAddrPrograms = []string{"cg_connect4", "cg_connect6", "cg_sendmsg4", "cg_recvmsg4"}
+
+func programType(pt ebpf.ProgramType) func() error {
+	return func() error { return features.HaveProgramType(pt) }
+}
+
+func mapType(mt ebpf.MapType) func() error {
+	return func() error { return features.HaveMapType(mt) }
+}
+
+func helper(pt ebpf.ProgramType, fn asm.BuiltinFunc) func() error {
+	return func() error { return features.HaveProgramHelper(pt, fn) }
+}
+
+// requiredFeatures lists what each program needs
+func requiredFeatures() []*Feature {
+	all := []string{"cg_connect4", "cg_connect6", "cg_sendmsg4", "cg_recvmsg4", "cg_sock_ops", "cg_sock_opt"}
+	return []*Feature{
+		{Name: "cgroup sock_addr programs", Programs: sockAddrPrograms, probe: programType(ebpf.CGroupSockAddr)},
+		{Name: "sock_ops programs", Programs: []string{"cg_sock_ops"}, probe: programType(ebpf.SockOps)},
+		{Name: "cgroup sockopt programs", Programs: []string{"cg_sock_opt"}, probe: programType(ebpf.CGroupSockopt)},
+		{Name: "LRU hash maps", Programs: all, probe: mapType(ebpf.LRUHash)},
+		{Name: "LPM trie maps", Programs: sockAddrPrograms, probe: mapType(ebpf.LPMTrie)},
+		{Name: "ring buffer maps", Programs: []string{"map_events"}, probe: mapType(ebpf.RingBuf)},
+		{Name: "sockhash maps", Programs: []string{"map_sock_hash", "sk_msg_fast_path"}, probe: mapType(ebpf.SockHash)},
+		{Name: "bpf_get_socket_cookie (sock_addr)", Programs: sockAddrPrograms, probe: helper(ebpf.CGroupSockAddr, asm.FnGetSocketCookie)},
+		{Name: "bpf_ringbuf_reserve (sock_addr)", Programs: []string{"map_events"}, probe: helper(ebpf.CGroupSockAddr, asm.FnRingbufReserve)},
+		{Name: "bpf_get_socket_cookie (sock_ops)", Programs: []string{"cg_sock_ops"}, probe: helper(ebpf.SockOps, asm.FnGetSocketCookie)},
+		{Name: "bpf_sock_ops_cb_flags_set (sock_ops)", Programs: []string{"cg_sock_ops"}, probe: helper(ebpf.SockOps, asm.FnSockOpsCbFlagsSet)},
+		{Name: "bpf_sock_hash_update (sock_ops)", Programs: []string{"map_sock_hash", "sk_msg_fast_path"}, probe: helper(ebpf.SockOps, asm.FnSockHashUpdate)},
+		{Name: "sk_lookup programs", Programs: []string{"sk_lookup_inbound"}, probe: programType(ebpf.SkLookup)},
+		{Name: "bpf_sk_assign (sk_lookup)", Programs: []string{"sk_lookup_inbound"}, probe: helper(ebpf.SkLookup, asm.FnSkAssign)},
+		{Name: "sk_msg programs", Programs: []string{"sk_msg_fast_path"}, probe: programType(ebpf.SkMsg)},
+		{Name: "bpf_msg_redirect_hash (sk_msg)", Programs: []string{"sk_msg_fast_path"}, probe: helper(ebpf.SkMsg, asm.FnMsgRedirectHash)},
+		{Name: "bpf_ringbuf_reserve (sockopt)", Programs: []string{"map_events"}, probe: helper(ebpf.CGroupSockopt, asm.FnRingbufReserve)},
+	}
+}
+
+// Compatibility is the result of the last probe
+var Compatibility []*Feature
+
+// probeFeatures checks every feature and returns the programs that can't be
+// loaded, it fails if a program we can't do without is one of them
+func probeFeatures() (map[string]bool, error) {
+	Compatibility = requiredFeatures()
+	disabled := map[string]bool{}
+	var missing []string
+	for _, f := range Compatibility {
+		err := f.probe()
+		switch {
+		case err == nil:
+			f.Supported = true
+		case errors.Is(err, ebpf.ErrNotSupported):
+			fallbacks, required := fallbacksOf(f)
+			if required {
+				missing = append(missing, f.Name)
+			} else {
+				f.Fallback = strings.Join(fallbacks, ", ")
+			}
+			for _, prog := range f.Programs {
+				disabled[prog] = true
+			}
+		default:
+			// The probe itself failed, let the verifier decide
+			f.Supported = true
+			f.Error = err.Error()
+		}
+	}
+	reportFeatures()
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("the kernel doesn't support %s, see the eBPF compatibility report", strings.Join(missing, ", "))
+	}
+	return disabled, nil
+}
+
+// fallbacksOf returns what we lose without f, and true if a program that needs
+// it is required
+func fallbacksOf(f *Feature) ([]string, bool) {
+	var fallbacks []string
+	for _, prog := range f.Programs {
+		fallback, ok := optionalPrograms[prog]
+		if !ok {
+			return nil, true
+		}
+		if !slices.Contains(fallbacks, fallback) {
+			fallbacks = append(fallbacks, fallback)
+		}
+	}
+	return fallbacks, false
+}
+
+// reportFeatures logs the compatibility report
+func reportFeatures() {
+	slog.Info("eBPF compatibility report:")
+	for _, f := range Compatibility {
+		switch {
+		case f.Error != "":
+			slog.Warnf("  %-40s unknown (%s)", f.Name, f.Error)
+		case f.Supported:
+			slog.Infof("  %-40s supported", f.Name)
+		case f.Fallback != "":
+			slog.Warnf("  %-40s missing, %s", f.Name, f.Fallback)
+		default:
+			slog.Errorf("  %-40s missing, required by %s", f.Name, strings.Join(f.Programs, ", "))
+		}
+	}
+}
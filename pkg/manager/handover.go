@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"smesh/pkg/connection"
+
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// A new proxy started with -handover connects to the running proxy on the
+// handover socket. The running proxy sends the names of its listening sockets
+// and the sockets themselves (SCM_RIGHTS), stops accepting and drains. The new
+// proxy listens on the same sockets so no connection is refused.
+
+// receiveHandover takes the listening sockets from the proxy on path
+func receiveHandover(path string) (map[string]*os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the running proxy: %v", err)
+	}
+	defer conn.Close()
+
+	names := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(64*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(names, oob)
+	if err != nil {
+		return nil, fmt.Errorf("receiving listeners: %v", err)
+	}
+	var order []string
+	err = json.Unmarshal(names[:n], &order)
+	if err != nil {
+		return nil, fmt.Errorf("decoding listener names: %v", err)
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("decoding listeners: %v", err)
+	}
+	var fds []int
+	for i := range messages {
+		rights, err := unix.ParseUnixRights(&messages[i])
+		if err != nil {
+			return nil, fmt.Errorf("decoding listeners: %v", err)
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != len(order) {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("received %d listeners for %d names", len(fds), len(order))
+	}
+	files := map[string]*os.File{}
+	for i, name := range order {
+		files[name] = os.NewFile(uintptr(fds[i]), name)
+	}
+	return files, nil
+}
+
+// serveHandover waits for a new proxy on path and gives it the listening
+// sockets, the returned channel is closed once it has them
+func serveHandover(ctx context.Context, c *connection.Config, path string) (<-chan struct{}, error) {
+	os.Remove(path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("listening for a handover: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Errorf("handover: %v", err)
+				}
+				return
+			}
+			err = sendHandover(c, conn)
+			conn.Close()
+			if err != nil {
+				slog.Errorf("handover failed: %v", err)
+				continue
+			}
+			listener.Close()
+			close(done)
+			return
+		}
+	}()
+	return done, nil
+}
+
+// sendHandover sends the listening sockets over conn
+func sendHandover(c *connection.Config, conn *net.UnixConn) error {
+	files, err := c.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	var order []string
+	var fds []int
+	for name, f := range files {
+		defer f.Close()
+		order = append(order, name)
+		fds = append(fds, int(f.Fd()))
+	}
+	names, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(names, unix.UnixRights(fds...), nil)
+	return err
+}
@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"smesh/pkg/connection"
+
+	"github.com/cilium/ebpf"
+	"github.com/gookit/slog"
+)
+
+// Inbound interception uses an sk_lookup program on the pod network namespace,
+// connections to the ports in map_inbound_ports are handed to the socket in
+// map_inbound_listener instead of the application's.
+
+// attachInbound attaches the sk_lookup program, STRICT mode can't be enforced
+// without it so that fails while PERMISSIVE mode falls back to off
+func attachInbound(c *connection.Config) error {
+	if c.InboundMode == connection.InboundOff {
+		return nil
+	}
+	err := fmt.Errorf("the kernel can't run sk_lookup programs")
+	if tracker.objs.SkLookupInbound != nil {
+		tracker.inboundLink, err = attachNetNs(tracker.pinDir, "sk_lookup_inbound", tracker.objs.SkLookupInbound)
+		if err == nil {
+			return nil
+		}
+	}
+	if c.InboundMode == connection.InboundStrict {
+		return fmt.Errorf("unable to intercept inbound connections for strict mode: %v", err)
+	}
+	slog.Warnf("inbound connections aren't intercepted: %v", err)
+	c.InboundMode = connection.InboundOff
+	return nil
+}
+
+// SyncInboundPorts makes map_inbound_ports match the configuration
+func SyncInboundPorts(c *connection.Config) error {
+	desired := map[uint16]uint8{}
+	if c.InboundMode != connection.InboundOff {
+		ports, err := parsePorts(c.InboundPorts)
+		if err != nil {
+			return err
+		}
+		for _, port := range ports {
+			switch int(port) {
+			case c.ProxyPort, c.ClusterPort, c.ClusterTLSPort, c.InboundPort:
+				return fmt.Errorf("inbound port %d is used by the proxy", port)
+			}
+			desired[port] = 1
+		}
+	}
+	return syncPortMap(tracker.objs.MapInboundPorts, desired)
+}
+
+// registerInboundListener tells the eBPF where to send inbound connections
+func registerInboundListener(listener net.Listener) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("inbound listener isn't TCP")
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var key uint32 = 0
+	controlErr := raw.Control(func(fd uintptr) {
+		err = tracker.objs.MapInboundListener.Update(&key, uint64(fd), ebpf.UpdateAny)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("updating inbound listener: %v", err)
+	}
+	return nil
+}
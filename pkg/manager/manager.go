@@ -3,23 +3,20 @@ package manager
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type Config mirrors ../../ebpf/mirrors.c
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
 	"smesh/pkg/connection"
 	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
-	"github.com/docker/docker/pkg/parsers/kernel"
 	"github.com/gookit/slog"
 )
 
@@ -29,82 +26,119 @@ var tracker struct {
 	objs         mirrorsObjects // out eBPF objects
 	cg           link.Link
 	connect4Link link.Link
+	connect6Link link.Link
 	sockopsLink  link.Link
 	sockoptLink  link.Link
+	sendmsg4Link link.Link
+	recvmsg4Link link.Link
+	inboundLink  link.Link
+	pinDir       string          // where the maps and links are pinned, empty if they aren't
+	disabled     map[string]bool // programs the kernel can't load or attach
 }
 
 func LoadEPF(c *connection.Config) error {
-	v, err := kernel.GetKernelVersion()
-	if err != nil {
-		slog.Errorf("unable to parse kernel version %v", err)
+	// Only needed on kernels without memcg accounting, this is a no-op otherwise
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return fmt.Errorf("removing memlock: %v", err)
 	}
 
-	slog.Infof("detected Kernel %d.%d.x", v.Kernel, v.Major)
+	disabled, err := probeFeatures()
+	if err != nil {
+		return err
+	}
 
-	// Remove resource limits for kernels <5.11.
-	if v.Kernel >= 5 && v.Major >= 11 {
-		if err := rlimit.RemoveMemlock(); err != nil {
-			return fmt.Errorf("removing memlock: %v", err)
-		}
+	cgroupPath, err := resolveCgroup(c)
+	if err != nil {
+		return err
 	}
 
-	// Load the compiled eBPF ELF and load it into the kernel
-	// NOTE: we could also pin the eBPF program
-	//var objs mirrorsObjects
-	if err := loadMirrorsObjects(&tracker.objs, nil); err != nil {
+	// Load the compiled eBPF ELF and load it into the kernel, the maps are
+	// pinned so that they outlive this process
+	tracker.pinDir = pinDir(c)
+	if err := loadObjects(tracker.pinDir, disabled); err != nil {
 		return fmt.Errorf("loading eBPF objects: %v", err)
 	}
-	//defer objs.Close()
-	// Attach eBPF programs to the root cgroup
-	tracker.connect4Link, err = link.AttachCgroup(link.CgroupOptions{
-		Path:    c.CgroupOverride,
-		Attach:  ebpf.AttachCGroupInet4Connect,
-		Program: tracker.objs.CgConnect4,
-	})
-	if err != nil {
-		return fmt.Errorf("attaching CgConnect4 program to Cgroup: %v", err)
-	}
-	// defer connect4Link.Close()
 
-	tracker.sockopsLink, err = link.AttachCgroup(link.CgroupOptions{
-		Path:    c.CgroupOverride,
-		Attach:  ebpf.AttachCGroupSockOps,
-		Program: tracker.objs.CgSockOps,
-	})
-	if err != nil {
-		return fmt.Errorf("attaching CgSockOps program to Cgroup: %v", err)
+	// Attach eBPF programs to the pod cgroup, the optional ones fall back if
+	// the kernel can't load or attach them
+	for _, a := range []struct {
+		name    string
+		attach  ebpf.AttachType
+		program *ebpf.Program
+		link    *link.Link
+	}{
+		{"cg_connect4", ebpf.AttachCGroupInet4Connect, tracker.objs.CgConnect4, &tracker.connect4Link},
+		{"cg_connect6", ebpf.AttachCGroupInet6Connect, tracker.objs.CgConnect6, &tracker.connect6Link},
+		{"cg_sock_ops", ebpf.AttachCGroupSockOps, tracker.objs.CgSockOps, &tracker.sockopsLink},
+		{"cg_sock_opt", ebpf.AttachCGroupGetsockopt, tracker.objs.CgSockOpt, &tracker.sockoptLink},
+		{"cg_sendmsg4", ebpf.AttachCGroupUDP4Sendmsg, tracker.objs.CgSendmsg4, &tracker.sendmsg4Link},
+		{"cg_recvmsg4", ebpf.AttachCGroupUDP4Recvmsg, tracker.objs.CgRecvmsg4, &tracker.recvmsg4Link},
+	} {
+		if a.program == nil {
+			continue
+		}
+		*a.link, err = attachCgroup(tracker.pinDir, a.name, cgroupPath, a.attach, a.program)
+		if err != nil {
+			fallback, ok := optionalPrograms[a.name]
+			if !ok {
+				return fmt.Errorf("attaching %s program to Cgroup: %v", a.name, err)
+			}
+			slog.Warnf("unable to attach %s, %s: %v", a.name, fallback, err)
+			disabled[a.name] = true
+		}
+	}
+	tracker.disabled = disabled
+	if disabled["cg_connect6"] && c.PodCIDR6 != "" {
+		slog.Warn("IPv6 interception is disabled")
+		c.PodCIDR6 = ""
+	}
+	if (disabled["cg_sendmsg4"] || disabled["cg_recvmsg4"]) && c.UDPPort != 0 {
+		slog.Warn("UDP interception is disabled")
+		c.UDPPort = 0
+	}
+	if c.UDPPort != 0 && c.PodCIDR6 != "" {
+		slog.Warn("UDP interception is IPv4 only, IPv6 datagrams bypass the proxy")
 	}
-	// defer sockopsLink.Close()
 
-	tracker.sockoptLink, err = link.AttachCgroup(link.CgroupOptions{
-		Path:    c.CgroupOverride,
-		Attach:  ebpf.AttachCGroupGetsockopt,
-		Program: tracker.objs.CgSockOpt,
-	})
+	// Attach the inbound interception to the pod network namespace
+	err = attachInbound(c)
 	if err != nil {
-		return fmt.Errorf("attaching CgSockOpt program to Cgroup: %v", err)
+		return err
 	}
-	// defer sockoptLink.Close()
-	// Update the proxyMaps map with the proxy server configuration, because we need to know the proxy server PID in order
-	// to filter out eBPF events generated by the proxy server itself so it would not proxy its own packets in a loop.
+	attachFastPath(c)
 
-	cidr := strings.Split(c.PodCIDR, "/")
-	if len(cidr) < 1 {
-		return fmt.Errorf("error parsing cidr %s", c.PodCIDR)
-	}
+	// Update the proxyMaps map with the proxy server configuration, because we need to know the mark on the proxy server
+	// sockets in order to skip them so it would not proxy its own packets in a loop.
 
-	var key uint32 = 0
-	i, err := strconv.Atoi(cidr[1])
+	// Populate the port lists before the config enables the include list
+	includePorts, err := SyncPorts(c)
 	if err != nil {
-		// ... handle error
-		return err
+		return fmt.Errorf("updating ports: %v", err)
 	}
+
+	var key uint32 = 0
 	config := mirrorsConfig{
-		ProxyPort: uint16(c.ProxyPort),
-		ProxyPid:  uint64(os.Getpid()),
-		ProxyAddr: uint32(connection.ToInt(c.Address)),
-		Network:   uint32(connection.ToInt(cidr[0])),
-		Mask:      uint16(i),
+		ProxyPort:  uint16(c.ProxyPort),
+		ProxyMark:  uint32(c.Mark),
+		ProxyAddr:  uint32(connection.ToInt(c.Address)),
+		ProxyAddr6: connection.ToWords6(c.Address6),
+
+		UdpProxyPort: uint16(c.UDPPort),
+	}
+	if c.ExcludeDNS {
+		config.ExcludeDns = 1
+	}
+	if c.Debug {
+		config.Debug = 1
+	}
+	if includePorts {
+		config.IncludePorts = 1
+	}
+	if c.FastPath {
+		config.FastPath = 1
+	}
+	if c.InboundMode == connection.InboundStrict {
+		config.InboundStrict = 1
 	}
 
 	err = tracker.objs.mirrorsMaps.MapConfig.Update(&key, &config, ebpf.UpdateAny)
@@ -112,25 +146,94 @@ func LoadEPF(c *connection.Config) error {
 		slog.Fatalf("Failed to update proxyMaps map: %v", err)
 	}
 
+	// Populate the intercepted (and excluded) CIDRs
+	err = SyncCIDRs(c)
+	if err != nil {
+		return fmt.Errorf("updating cidrs: %v", err)
+	}
+
+	err = SyncPolicies(c)
+	if err != nil {
+		return fmt.Errorf("updating policies: %v", err)
+	}
+
+	err = SyncInboundPorts(c)
+	if err != nil {
+		return fmt.Errorf("updating inbound ports: %v", err)
+	}
+
+	setReadiness(func(r *Readiness) { r.EBPF = true })
 	return nil
 }
 
-func cleanup() {
+// cleanup detaches the eBPF, if unpin is false the pinned links and maps are
+// left for the next proxy
+func cleanup(unpin bool) {
+	for _, l := range []link.Link{
+		tracker.connect4Link,
+		tracker.connect6Link,
+		tracker.sockopsLink,
+		tracker.sockoptLink,
+		tracker.sendmsg4Link,
+		tracker.recvmsg4Link,
+		tracker.inboundLink,
+	} {
+		if l != nil {
+			l.Close()
+		}
+	}
 	tracker.objs.Close()
-	tracker.connect4Link.Close()
-	tracker.sockopsLink.Close()
-	tracker.sockoptLink.Close()
+	if unpin {
+		err := removePins(tracker.pinDir)
+		if err != nil {
+			slog.Error(err)
+		}
+	}
 }
 
 func Setup() (*connection.Config, error) {
 	var c connection.Config
 	flag.StringVar(&c.Address, "address", "127.0.0.1", "Address to bind to, can also be a hostname")
 	flag.StringVar(&c.ClusterAddress, "overrideAddress", "", "Address to force all traffic to")
-	flag.StringVar(&c.CgroupOverride, "cgroupPath", "/sys/fs/cgroup", "Path for cgroup")
+	flag.StringVar(&c.CgroupOverride, "cgroupPath", "", "Path for cgroup (empty discovers the pod cgroup)")
+	flag.BoolVar(&c.ForceRootCgroup, "forceRootCgroup", false, "Allow attaching to the root cgroup, this intercepts every process on the node")
+	flag.StringVar(&c.HostCgroup, "hostCgroup", "/host/sys/fs/cgroup", "Where the node's cgroup v2 hierarchy is mounted, used to find the pod cgroup from a private cgroup namespace")
 	flag.IntVar(&c.ProxyPort, "proxyPort", 18000, "Port for internal proxy")
 	flag.IntVar(&c.ClusterPort, "clusterPort", 18001, "External port for cluster connectivity")
 	flag.IntVar(&c.ClusterTLSPort, "clusterTLSPort", 18443, "External port for cluster connectivity (TLS)")
-	flag.StringVar(&c.PodCIDR, "podCIDR", "10.244.0.0/16", "The CIDR range used for POD IP addresses")
+	flag.IntVar(&c.UDPPort, "udpPort", 18053, "Port for the internal UDP relay (0 disables UDP interception)")
+	flag.BoolVar(&c.ExcludeDNS, "excludeDNS", true, "Don't intercept UDP traffic to port 53")
+	flag.StringVar(&c.PodCIDR, "podCIDR", "10.244.0.0/16", "The CIDR ranges (comma separated) used for POD IP addresses")
+	flag.StringVar(&c.Address6, "address6", "::1", "IPv6 address to bind the internal proxy to")
+	flag.StringVar(&c.PodCIDR6, "podCIDR6", "", "The IPv6 CIDR ranges (comma separated) used for POD IP addresses (empty disables IPv6)")
+	flag.StringVar(&c.ExcludeCIDRs, "excludeCIDRs", "", "CIDR ranges (comma separated) that are never intercepted")
+	flag.StringVar(&c.CIDRFile, "cidrFile", "", "YAML file with include and exclude lists of CIDRs, reloaded while running")
+	flag.BoolVar(&c.KubeCIDRs, "kubeCIDRs", false, "Intercept the node pod CIDRs and service CIDRs found in Kubernetes")
+	flag.StringVar(&c.PolicyFile, "policyFile", "", "YAML file with a list of destination policies (cidr, port, action: redirect|bypass|deny)")
+	flag.DurationVar(&c.CIDRRefresh, "cidrRefresh", time.Minute, "How often the CIDR file, policy file and Kubernetes are checked for changes")
+	flag.BoolVar(&c.Tunnel, "tunnel", false, "Multiplex connections to remote proxies over a shared HTTP/2 tunnel")
+	flag.BoolVar(&c.KTLS, "ktls", false, "Use kernel TLS for connections to remote proxies when available")
+	flag.DurationVar(&c.IdleTimeout, "idleTimeout", time.Hour, "Close proxied connections that have been idle for this long (0 disables)")
+	flag.DurationVar(&c.MaxLifetime, "maxLifetime", 0, "Close proxied connections after this long (0 disables)")
+	flag.StringVar(&c.ExcludePorts, "excludePorts", "", "Outbound ports or ranges (comma separated) that are never intercepted")
+	flag.StringVar(&c.IncludePorts, "includePorts", "", "Only intercept these outbound ports or ranges (comma separated), empty intercepts all")
+	flag.StringVar(&c.MetricsAddress, "metricsAddress", ":18090", "Address to serve the Prometheus metrics on (/metrics), empty disables it")
+	flag.StringVar(&c.HealthAddress, "healthAddress", ":18092", "Address to serve /healthz and /readyz on for the kubelet's probes, empty disables it")
+	flag.StringVar(&c.AccessLog, "accessLog", "", "File to write a JSON record for every proxied connection to (- for stdout), empty disables it")
+	flag.Float64Var(&c.AccessLogSample, "accessLogSample", 1, "Fraction of successful connections written to the access log (failures are always written)")
+	flag.StringVar(&c.AdminAddress, "adminAddress", "127.0.0.1:18091", "Address to serve the admin API on (/connections, /config, /certs, /ebpf, /healthz, /readyz, /debug/pprof/), empty disables it")
+	flag.StringVar(&c.DebugAddress, "debugAddress", "", "Address to serve the eBPF event stream on (/debug/events), empty disables it")
+	flag.StringVar(&c.InboundMode, "inboundMode", "off", "Inbound interception of the application ports: off, permissive (plaintext is still allowed) or strict (only mTLS peers)")
+	flag.IntVar(&c.InboundPort, "inboundPort", 18002, "Port inbound connections to the application are steered to")
+	flag.StringVar(&c.InboundPorts, "inboundPorts", "", "Application ports or ranges (comma separated) whose inbound connections are intercepted")
+	flag.BoolVar(&c.FastPath, "fastPath", false, "Move data between the application and the proxy with sockmap instead of the loopback TCP stack")
+	flag.IntVar(&c.Mark, "mark", 0x736d, "SO_MARK set on the proxy's own sockets so they aren't intercepted")
+	flag.StringVar(&c.PinPath, "pinPath", "/sys/fs/bpf/smesh", "bpffs directory the eBPF maps and links are pinned under (per pod), empty disables pinning")
+	flag.BoolVar(&c.RequireCertificates, "requireCertificates", false, "Exit if no certificates are found rather than running without TLS")
+	flag.BoolVar(&c.Handover, "handover", false, "Take over the listening sockets of the running proxy (for upgrades)")
+	flag.StringVar(&c.HandoverSocket, "handoverSocket", "/tmp/smesh-handover.sock", "Unix socket used to hand the listening sockets to a new proxy")
+	flag.DurationVar(&c.DrainTimeout, "drainTimeout", 30*time.Second, "How long to wait for connections to finish after handing over")
+	proxyProtocolPorts := flag.String("proxyProtocolPorts", "", "Comma separated application ports that receive a PROXY protocol v2 header (* for all)")
 	flag.Parse()
 
 	// Lookup for environment variable
@@ -139,6 +242,20 @@ func Setup() (*connection.Config, error) {
 		c.ClusterAddress = envAddress
 	}
 	//_, gateway := os.LookupEnv("KUBE_GATEWAY")
+	// Log every eBPF event, including connections that aren't intercepted
+	_, c.Debug = os.LookupEnv("DEBUG")
+
+	if c.Mark == 0 {
+		return nil, fmt.Errorf("-mark can't be 0, the proxy would intercept its own connections")
+	}
+
+	// The hostname is the pod name, the webhook sets the UID
+	c.PodName, _ = os.Hostname()
+	c.PodUID = os.Getenv("SMESH_POD_UID")
+	err := c.OpenAccessLog()
+	if err != nil {
+		return nil, err
+	}
 
 	i, err := net.ResolveIPAddr("", c.Address)
 	if err != nil {
@@ -146,11 +263,69 @@ func Setup() (*connection.Config, error) {
 	}
 	c.Address = i.String()
 
+	// Overwrite the proxy protocol ports, the webhook sets this from a pod annotation
+	envPorts, exists := os.LookupEnv("SMESH_PROXY_PROTOCOL_PORTS")
+	if exists && envPorts != "" {
+		*proxyProtocolPorts = envPorts
+	}
+	c.ProxyProtocolPorts, err = connection.ParseProxyProtocolPorts(*proxyProtocolPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite the port lists, the webhook sets these from pod annotations
+	envPorts, exists = os.LookupEnv("SMESH_EXCLUDE_PORTS")
+	if exists && envPorts != "" {
+		c.ExcludePorts = envPorts
+	}
+	envPorts, exists = os.LookupEnv("SMESH_INCLUDE_PORTS")
+	if exists && envPorts != "" {
+		c.IncludePorts = envPorts
+	}
+
+	// Overwrite the inbound interception, the webhook sets these from pod annotations
+	envMode, exists := os.LookupEnv("SMESH_INBOUND_MODE")
+	if exists && envMode != "" {
+		c.InboundMode = envMode
+	}
+	envPorts, exists = os.LookupEnv("SMESH_INBOUND_PORTS")
+	if exists && envPorts != "" {
+		c.InboundPorts = envPorts
+	}
+	// Otherwise the ports declared by the application containers
+	envPorts, exists = os.LookupEnv("SMESH_DECLARED_PORTS")
+	if exists && envPorts != "" && c.InboundPorts == "" {
+		c.InboundPorts = envPorts
+	}
+	c.InboundMode, err = connection.ParseInboundMode(c.InboundMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// The webhook sets this to the port of the sidecar's startupProbe
+	envHealth, exists := os.LookupEnv("SMESH_HEALTH_ADDRESS")
+	if exists && envHealth != "" {
+		c.HealthAddress = envHealth
+	}
+
+	// The webhook sets this, the injected proxy won't be ready without certificates
+	envRequire, exists := os.LookupEnv("SMESH_REQUIRE_CERTIFICATES")
+	if exists && envRequire != "" {
+		c.RequireCertificates, err = strconv.ParseBool(envRequire)
+		if err != nil {
+			return nil, fmt.Errorf("SMESH_REQUIRE_CERTIFICATES [%s] isn't a boolean", envRequire)
+		}
+	}
+
 	// Overwrite the podcidr
 	podCIDR, exists := os.LookupEnv("POD_CIDR")
 	if exists {
 		c.PodCIDR = podCIDR
 	}
+	podCIDR6, exists := os.LookupEnv("POD_CIDR6")
+	if exists {
+		c.PodCIDR6 = podCIDR6
+	}
 
 	return &c, nil
 }
@@ -159,16 +334,59 @@ func Setup() (*connection.Config, error) {
 func Start(c *connection.Config) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+
+	if c.Handover {
+		var err error
+		c.Inherited, err = receiveHandover(c.HandoverSocket)
+		if err != nil {
+			return err
+		}
+		slog.Infof("took over %d listeners from the running proxy", len(c.Inherited))
+	}
 	// Start the proxy server on the localhost
-	// We only demonstrate IPv4 in this example, but the same approach can be used for IPv6
-	c.Socks = tracker.objs.MapSocks
+	go watchCIDRs(ctx, c)
+	go watchMaps(ctx)
+	go readEvents(ctx, c.Debug)
+	if c.DebugAddress != "" {
+		go startDebugServer(ctx, c.DebugAddress)
+	}
+	if c.MetricsAddress != "" {
+		go startMetricsServer(ctx, c.MetricsAddress)
+	}
+	if c.HealthAddress != "" {
+		go startHealthServer(ctx, c.HealthAddress)
+	}
+	if c.AdminAddress != "" {
+		go startAdminServer(ctx, c, c.AdminAddress)
+	}
+
+	c.Update(func(c *connection.Config) {
+		c.Socks = tracker.objs.MapSocks
+		c.Socks6 = tracker.objs.MapSocks6
+		c.ProxySocks = tracker.objs.MapProxySocks
+	})
 	internalListener := c.StartInternalListener()
 	defer internalListener.Close()
 	go c.StartListeners(internalListener, true)
 
+	if c.PodCIDR6 != "" {
+		internalListener6 := c.StartInternalListener6()
+		defer internalListener6.Close()
+		go c.StartListeners(internalListener6, true)
+	}
+
+	if c.UDPPort != 0 {
+		c.Update(func(c *connection.Config) {
+			c.UDPSocks = tracker.objs.MapUdpSocks
+			c.UDPReplies = tracker.objs.MapUdpReplies
+			c.UDPFlows = tracker.objs.MapUdpFlows
+		})
+		udpListener := c.StartUDPListener()
+		defer udpListener.Close()
+		go c.StartUDPRelay(udpListener)
+	}
+
 	var err error
-	externalListener := c.StartExternalListener()
-	defer externalListener.Close()
 
 	// Attempt to get certificates from API
 	// c.Certificates, err = getKubeCerts(os.Getenv("KUBECONFIG"))
@@ -176,14 +394,25 @@ func Start(c *connection.Config) error {
 	// 	slog.Error(err)
 	// Attempt to get from environment secrets
 
-	c.Certificates, err = connection.GetEnvCerts()
+	certs, err := connection.GetEnvCerts()
 	if err != nil {
 		slog.Error(err)
-		c.Certificates, err = connection.GetFSCerts()
+		certs, err = connection.GetFSCerts()
 		if err != nil {
 			slog.Error(err)
 		}
 	}
+	c.Update(func(c *connection.Config) { c.Certificates = certs })
+
+	if c.InboundMode == connection.InboundStrict && c.Certificates == nil {
+		cleanup(true)
+		return fmt.Errorf("strict inbound mode needs certificates")
+	}
+	if c.RequireCertificates && c.Certificates == nil {
+		cleanup(true)
+		return fmt.Errorf("no certificates were found")
+	}
+	setReadiness(func(r *Readiness) { r.Certificates = true })
 
 	// If we have secrets enable a TLS listener
 	if c.Certificates != nil {
@@ -192,38 +421,49 @@ func Start(c *connection.Config) error {
 		go c.StartTLSListener(externalTLSListener)
 	}
 
-	go c.StartListeners(externalListener, false)
-	_, exists := os.LookupEnv("DEBUG")
-	if exists {
-		go cat()
+	// Plaintext peers are refused in strict mode
+	if c.InboundMode != connection.InboundStrict {
+		externalListener := c.StartExternalListener()
+		defer externalListener.Close()
+		go c.StartListeners(externalListener, false)
 	}
-	<-ctx.Done() // We wait here
-
-	return nil
-}
 
-func readLines(r io.Reader) {
-	rd := bufio.NewReader(r)
-	for {
-		line, err := rd.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
+	if c.InboundMode != connection.InboundOff {
+		inboundListener := c.StartInboundListener()
+		defer inboundListener.Close()
+		err = registerInboundListener(inboundListener)
 		if err != nil {
-			panic(fmt.Sprintf("Error reading lines %v", err))
+			// Strict mode mustn't come up without enforcing it
+			if c.InboundMode == connection.InboundStrict {
+				cleanup(true)
+				return fmt.Errorf("strict inbound mode: %v", err)
+			}
+			slog.Warnf("inbound connections aren't intercepted: %v", err)
 		}
-
-		fmt.Printf("%s", line)
-
+		go c.StartInboundListeners(inboundListener)
 	}
-}
 
-func cat() {
-	file, err := os.Open("/sys/kernel/debug/tracing/trace_pipe")
+	handedOver, err := serveHandover(ctx, c, c.HandoverSocket)
 	if err != nil {
-		fmt.Printf("Error trace pipe %v\n", err)
-		return
+		slog.Error(err)
+	}
+	setReadiness(func(r *Readiness) { r.Listeners = true })
+
+	select { // We wait here
+	case <-ctx.Done():
+		setReadiness(func(r *Readiness) { r.Listeners = false })
+		cleanup(true)
+	case <-handedOver:
+		setReadiness(func(r *Readiness) { r.Listeners = false })
+		// The new proxy has the listeners and the pinned eBPF, let our own
+		// connections finish and leave everything else in place
+		slog.Info("handed over to the new proxy, draining connections")
+		c.CloseListeners()
+		if !c.Drain(c.DrainTimeout) {
+			slog.Warnf("connections still open after %v", c.DrainTimeout)
+		}
+		cleanup(false)
 	}
-	defer file.Close()
-	readLines(file)
+
+	return nil
 }
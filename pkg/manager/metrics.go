@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gookit/slog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The connection metrics live in the connection package, these are the eBPF
+// ones. Everything is served on /metrics.
+
+var (
+	mapEntriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smesh_ebpf_map_entries",
+		Help: "Entries in the eBPF maps that grow with the number of connections.",
+	}, []string{"map"})
+
+	mapCapacityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smesh_ebpf_map_capacity",
+		Help: "Maximum entries of the eBPF maps that grow with the number of connections.",
+	}, []string{"map"})
+
+	ebpfEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "smesh_ebpf_events_total",
+		Help: "Decisions made by the eBPF programs by type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(mapEntriesGauge, mapCapacityGauge, ebpfEvents)
+}
+
+// startMetricsServer serves the Prometheus metrics on address until ctx is done
+func startMetricsServer(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Infof("metrics endpoint http://%s/metrics", address)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("metrics endpoint failed: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/gookit/slog"
+)
+
+// The connection tracking maps are cleaned up by the eBPF when sockets close
+// (and are LRU maps as a backstop), but if they fill up then new connections
+// stop being intercepted, so we keep an eye on them.
+
+// How often the maps are counted and how full they get before we warn
+const (
+	mapCheckInterval = 30 * time.Second
+	mapWarnThreshold = 0.8
+)
+
+// trackedMaps are the maps that grow with the number of connections
+func trackedMaps() map[string]*ebpf.Map {
+	return map[string]*ebpf.Map{
+		"map_socks":       tracker.objs.MapSocks,
+		"map_socks6":      tracker.objs.MapSocks6,
+		"map_ports":       tracker.objs.MapPorts,
+		"map_proxy_socks": tracker.objs.MapProxySocks,
+		"map_udp_socks":   tracker.objs.MapUdpSocks,
+		"map_udp_replies": tracker.objs.MapUdpReplies,
+		"map_udp_flows":   tracker.objs.MapUdpFlows,
+	}
+}
+
+// countEntries walks a map, there is no cheaper way to find its size
+func countEntries(m *ebpf.Map) (int, error) {
+	var key, value []byte
+	count := 0
+	entries := m.Iterate()
+	for entries.Next(&key, &value) {
+		count++
+	}
+	return count, entries.Err()
+}
+
+// checkMaps updates the gauges and warns about maps that are nearly full
+func checkMaps() {
+	for name, m := range trackedMaps() {
+		if m == nil {
+			continue
+		}
+		count, err := countEntries(m)
+		if err != nil {
+			slog.Debugf("unable to count entries in %s: %v", name, err)
+			continue
+		}
+		max := m.MaxEntries()
+		mapEntriesGauge.WithLabelValues(name).Set(float64(count))
+		mapCapacityGauge.WithLabelValues(name).Set(float64(max))
+		if max != 0 && float64(count) >= mapWarnThreshold*float64(max) {
+			slog.Warnf("%s is %d%% full (%d/%d), new connections may not be intercepted", name, count*100/int(max), count, max)
+		}
+	}
+}
+
+// watchMaps checks the maps until ctx is done
+func watchMaps(ctx context.Context) {
+	ticker := time.NewTicker(mapCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkMaps()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"smesh/pkg/connection"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/gookit/slog"
+	"golang.org/x/sys/unix"
+)
+
+// The maps and links are pinned under a per-pod directory on bpffs. A proxy
+// that crashes leaves interception in place (and the sockets in map_socks), and
+// the next one re-uses the pinned maps and swaps its programs into the pinned
+// links instead of attaching a second copy. The directory is named after the
+// pod UID, a pod that is recreated with the same name (a StatefulSet) is in a
+// new cgroup and mustn't pick up the links of the old one.
+
+// pinDir returns the per-pod pin directory, or "" if pinning isn't possible
+func pinDir(c *connection.Config) string {
+	if c.PinPath == "" {
+		return ""
+	}
+	var fs unix.Statfs_t
+	err := unix.Statfs(c.PinPath, &fs)
+	if err != nil || fs.Type != unix.BPF_FS_MAGIC {
+		slog.Warnf("%s is not on bpffs, eBPF objects won't be pinned", c.PinPath)
+		return ""
+	}
+	if c.PodUID == "" {
+		slog.Warn("unable to find the pod UID (SMESH_POD_UID), eBPF objects won't be pinned")
+		return ""
+	}
+	dir := filepath.Join(c.PinPath, c.PodUID)
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		slog.Warnf("unable to create %s, eBPF objects won't be pinned: %v", dir, err)
+		return ""
+	}
+	return dir
+}
+
+// loadObjects loads the eBPF, leaving out the disabled programs and re-using
+// any maps pinned in dir
+func loadObjects(dir string, disabled map[string]bool) error {
+	opts := ebpf.CollectionOptions{}
+	if dir != "" {
+		opts.Maps.PinPath = dir
+	}
+	err := loadCollection(opts, disabled)
+	if dir != "" && errors.Is(err, ebpf.ErrMapIncompatible) {
+		// The pins are from a different version of the eBPF, start again
+		slog.Warnf("pinned eBPF maps in %s are incompatible, replacing them", dir)
+		err = removePins(dir)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return err
+		}
+		err = loadCollection(opts, disabled)
+	}
+	return err
+}
+
+// loadCollection loads the eBPF into tracker.objs, the disabled programs are
+// left nil
+func loadCollection(opts ebpf.CollectionOptions, disabled map[string]bool) error {
+	spec, err := loadMirrors()
+	if err != nil {
+		return err
+	}
+	for name := range disabled {
+		delete(spec.Programs, name)
+	}
+	// Kernels without ring buffers or sockhashes can't create the maps, so they
+	// are swapped for a placeholder and the constants tell the verifier that
+	// the code using them is dead
+	constants := map[string]interface{}{}
+	if disabled["map_events"] {
+		spec.Maps["map_events"] = placeholderMap("map_events")
+		constants["have_ringbuf"] = uint8(0)
+	}
+	if disabled["map_sock_hash"] || disabled["sk_msg_fast_path"] {
+		spec.Maps["map_sock_hash"] = placeholderMap("map_sock_hash")
+		constants["have_sockhash"] = uint8(0)
+	}
+	err = spec.RewriteConstants(constants)
+	if err != nil {
+		return err
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, opts)
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	err = coll.Assign(&tracker.objs.mirrorsMaps)
+	if err != nil {
+		return err
+	}
+	for name, prog := range map[string]**ebpf.Program{
+		"cg_connect4": &tracker.objs.CgConnect4,
+		"cg_connect6": &tracker.objs.CgConnect6,
+		"cg_sendmsg4": &tracker.objs.CgSendmsg4,
+		"cg_recvmsg4": &tracker.objs.CgRecvmsg4,
+		"cg_sock_ops": &tracker.objs.CgSockOps,
+		"cg_sock_opt": &tracker.objs.CgSockOpt,
+
+		"sk_lookup_inbound": &tracker.objs.SkLookupInbound,
+		"sk_msg_fast_path":  &tracker.objs.SkMsgFastPath,
+	} {
+		*prog = coll.DetachProgram(name)
+	}
+	return nil
+}
+
+// placeholderMap is the smallest map that can stand in for one the kernel
+// can't create
+func placeholderMap(name string) *ebpf.MapSpec {
+	return &ebpf.MapSpec{Name: name, Type: ebpf.Array, KeySize: 4, ValueSize: 4, MaxEntries: 1}
+}
+
+// attachCgroup attaches prog to the cgroup, re-using the link pinned in dir
+func attachCgroup(dir, name, cgroupPath string, attach ebpf.AttachType, prog *ebpf.Program) (link.Link, error) {
+	return attachPinned(dir, name, prog, func() (link.Link, error) {
+		return link.AttachCgroup(link.CgroupOptions{
+			Path:    cgroupPath,
+			Attach:  attach,
+			Program: prog,
+		})
+	})
+}
+
+// attachNetNs attaches prog to our network namespace, re-using the link pinned
+// in dir
+func attachNetNs(dir, name string, prog *ebpf.Program) (link.Link, error) {
+	return attachPinned(dir, name, prog, func() (link.Link, error) {
+		ns, err := os.Open("/proc/self/ns/net")
+		if err != nil {
+			return nil, err
+		}
+		defer ns.Close()
+		return link.AttachNetNs(int(ns.Fd()), prog)
+	})
+}
+
+// attachPinned swaps prog into the link pinned in dir, or attaches it and pins
+// the new link
+func attachPinned(dir, name string, prog *ebpf.Program, attach func() (link.Link, error)) (link.Link, error) {
+	pin := filepath.Join(dir, name)
+	if dir != "" {
+		l, err := link.LoadPinnedLink(pin, nil)
+		if err == nil {
+			err = l.Update(prog)
+			if err == nil {
+				slog.Infof("re-using pinned %s link", name)
+				return l, nil
+			}
+			slog.Warnf("unable to update pinned %s link, replacing it: %v", name, err)
+			l.Close()
+			os.Remove(pin)
+		}
+	}
+	l, err := attach()
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		err = l.Pin(pin)
+		if err != nil {
+			// Older kernels don't have bpf_link, the program goes when we do
+			slog.Warnf("unable to pin %s link: %v", name, err)
+		}
+	}
+	return l, nil
+}
+
+// removePins removes everything pinned in dir
+func removePins(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return fmt.Errorf("removing pins in %s: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"smesh/pkg/connection"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policies decide what happens to a connection (or UDP datagram) before the
+// intercepted ranges are checked, the excluded ports still win over a
+// redirect. They are keyed by destination prefix and port (0 for any port), a
+// rule for the exact port wins over one for any port.
+
+// These match POLICY_REDIRECT, POLICY_BYPASS and POLICY_DENY in the eBPF
+const (
+	PolicyRedirect uint8 = 1
+	PolicyBypass   uint8 = 2
+	PolicyDeny     uint8 = 3
+)
+
+var policyActions = map[string]uint8{
+	"redirect": PolicyRedirect,
+	"bypass":   PolicyBypass,
+	"deny":     PolicyDeny,
+}
+
+// PolicyRule is a single destination policy, the format of the -policyFile is
+// a list of these
+type PolicyRule struct {
+	CIDR   string `yaml:"cidr"`
+	Port   uint16 `yaml:"port"`
+	Action string `yaml:"action"`
+}
+
+// policyKey4 matches struct Policy4 in the eBPF
+type policyKey4 struct {
+	PrefixLen uint32
+	Port      uint16
+	Addr      [4]byte
+	_         [2]byte
+}
+
+// policyKey6 matches struct Policy6 in the eBPF
+type policyKey6 struct {
+	PrefixLen uint32
+	Port      uint16
+	Addr      [16]byte
+	_         [2]byte
+}
+
+func (r PolicyRule) parse() (netip.Prefix, uint8, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(r.CIDR))
+	if err != nil {
+		return prefix, 0, fmt.Errorf("error parsing policy cidr %s: %v", r.CIDR, err)
+	}
+	action, ok := policyActions[strings.ToLower(r.Action)]
+	if !ok {
+		return prefix, 0, fmt.Errorf("unknown policy action [%s] for %s", r.Action, r.CIDR)
+	}
+	return prefix.Masked(), action, nil
+}
+
+// desiredPolicies reads the rules from the policy file
+func desiredPolicies(c *connection.Config) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	if c.PolicyFile == "" {
+		return rules, nil
+	}
+	b, err := os.ReadFile(c.PolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file [%v]", err)
+	}
+	err = yaml.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse policy file [%v]", err)
+	}
+	return rules, nil
+}
+
+// Serialises updates to the policy maps
+var policySync sync.Mutex
+
+// SyncPolicies makes the eBPF policy maps match the configured rules
+func SyncPolicies(c *connection.Config) error {
+	policySync.Lock()
+	defer policySync.Unlock()
+	rules, err := desiredPolicies(c)
+	if err != nil {
+		return err
+	}
+	desired4 := map[policyKey4]uint8{}
+	desired6 := map[policyKey6]uint8{}
+	for _, rule := range rules {
+		prefix, action, err := rule.parse()
+		if err != nil {
+			return err
+		}
+		if prefix.Addr().Is4() {
+			desired4[policyKey4{PrefixLen: uint32(16 + prefix.Bits()), Port: rule.Port, Addr: prefix.Addr().As4()}] = action
+			continue
+		}
+		// Like the IPv6 cidrs, there is nothing to redirect to without -podCIDR6
+		if c.PodCIDR6 == "" && action == PolicyRedirect {
+			continue
+		}
+		desired6[policyKey6{PrefixLen: uint32(16 + prefix.Bits()), Port: rule.Port, Addr: prefix.Addr().As16()}] = action
+	}
+	err = syncMap(tracker.objs.MapPolicy, desired4)
+	if err != nil {
+		return err
+	}
+	return syncMap(tracker.objs.MapPolicy6, desired6)
+}
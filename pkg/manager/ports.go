@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"fmt"
+	"smesh/pkg/connection"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+)
+
+// Outbound ports are captured unless they are in map_excluded_ports, if any
+// ports are included then only those are captured. The proxy's own ports are
+// always excluded so that proxies can talk to each other.
+
+// portWords matches PORT_WORDS in the eBPF, the port maps are bitmaps with a
+// bit for every port
+const portWords = 65536 / 64
+
+// parsePorts parses a comma separated list of ports and port ranges (8000-8010)
+func parsePorts(ports string) ([]uint16, error) {
+	var parsed []uint16
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(p, "-")
+		start, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse port [%s]: %v", p, err)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.ParseUint(last, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse port [%s]: %v", p, err)
+			}
+		}
+		if start == 0 || end < start {
+			return nil, fmt.Errorf("invalid port range [%s]", p)
+		}
+		for port := start; port <= end; port++ {
+			parsed = append(parsed, uint16(port))
+		}
+	}
+	return parsed, nil
+}
+
+// SyncPorts makes the eBPF port maps match the configuration, it returns true
+// if there is an include list
+func SyncPorts(c *connection.Config) (bool, error) {
+	excluded, err := parsePorts(c.ExcludePorts)
+	if err != nil {
+		return false, err
+	}
+	included, err := parsePorts(c.IncludePorts)
+	if err != nil {
+		return false, err
+	}
+
+	desiredExcluded := map[uint16]uint8{
+		uint16(c.ProxyPort):      1,
+		uint16(c.ClusterPort):    1,
+		uint16(c.ClusterTLSPort): 1,
+	}
+	for _, port := range excluded {
+		desiredExcluded[port] = 1
+	}
+	desiredIncluded := map[uint16]uint8{}
+	for _, port := range included {
+		desiredIncluded[port] = 1
+	}
+
+	err = syncPortMap(tracker.objs.MapExcludedPorts, desiredExcluded)
+	if err != nil {
+		return false, err
+	}
+	err = syncPortMap(tracker.objs.MapIncludedPorts, desiredIncluded)
+	if err != nil {
+		return false, err
+	}
+	return len(desiredIncluded) != 0, nil
+}
+
+// portBitmap sets the bit of every port
+func portBitmap(ports map[uint16]uint8) []uint64 {
+	bitmap := make([]uint64, portWords)
+	for port := range ports {
+		bitmap[port/64] |= 1 << (port % 64)
+	}
+	return bitmap
+}
+
+// syncPortMap makes a port bitmap match ports, only the words that change are
+// written
+func syncPortMap(m *ebpf.Map, ports map[uint16]uint8) error {
+	desired := portBitmap(ports)
+	for word := uint32(0); word < portWords; word++ {
+		var current uint64
+		err := m.Lookup(&word, &current)
+		if err != nil {
+			return fmt.Errorf("reading word %d of %s: %v", word, m, err)
+		}
+		if current == desired[word] {
+			continue
+		}
+		err = m.Update(&word, &desired[word], ebpf.UpdateExist)
+		if err != nil {
+			return fmt.Errorf("updating word %d of %s: %v", word, m, err)
+		}
+	}
+	return nil
+}
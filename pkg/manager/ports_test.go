@@ -0,0 +1,76 @@
+package manager
+
+import "testing"
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   string
+		first   uint16
+		last    uint16
+		count   int
+		wantErr bool
+	}{
+		{name: "empty", ports: ""},
+		{name: "single", ports: "8080", first: 8080, last: 8080, count: 1},
+		{name: "list", ports: " 80, 443,,8443 ", first: 80, last: 8443, count: 3},
+		{name: "range", ports: "8000-8010", first: 8000, last: 8010, count: 11},
+		{name: "node ports", ports: "30000-32767", first: 30000, last: 32767, count: 2768},
+		{name: "every port", ports: "1-65535", first: 1, last: 65535, count: 65535},
+		{name: "mixed", ports: "22,8000-8002", first: 22, last: 8002, count: 4},
+		{name: "zero", ports: "0", wantErr: true},
+		{name: "backwards range", ports: "8010-8000", wantErr: true},
+		{name: "not a number", ports: "http", wantErr: true},
+		{name: "bad range end", ports: "8000-x", wantErr: true},
+		{name: "out of range", ports: "65536", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePorts(tt.ports)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d ports", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.count {
+				t.Fatalf("got %d ports, want %d", len(got), tt.count)
+			}
+			if tt.count > 0 && (got[0] != tt.first || got[len(got)-1] != tt.last) {
+				t.Errorf("got %d-%d, want %d-%d", got[0], got[len(got)-1], tt.first, tt.last)
+			}
+		})
+	}
+}
+
+func TestPortBitmap(t *testing.T) {
+	tests := []struct {
+		port uint16
+		word int
+		bit  uint64
+	}{
+		{port: 1, word: 0, bit: 1 << 1},
+		{port: 63, word: 0, bit: 1 << 63},
+		{port: 64, word: 1, bit: 1},
+		{port: 8080, word: 126, bit: 1 << 16},
+		{port: 65535, word: portWords - 1, bit: 1 << 63},
+	}
+	for _, tt := range tests {
+		bitmap := portBitmap(map[uint16]uint8{tt.port: 1})
+		if len(bitmap) != portWords {
+			t.Fatalf("got %d words, want %d", len(bitmap), portWords)
+		}
+		for word, bits := range bitmap {
+			want := uint64(0)
+			if word == tt.word {
+				want = tt.bit
+			}
+			if bits != want {
+				t.Errorf("port %d: word %d is %#x, want %#x", tt.port, word, bits, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gookit/slog"
+)
+
+// The proxy is ready once interception is live: the eBPF is attached, the
+// certificates are loaded (when we need them) and the listeners are up. The
+// injected sidecar has a startupProbe on /readyz, so the application
+// containers don't start before then. The probes have their own listener so
+// they don't depend on the metrics (or the admin API, which is only on
+// localhost) being enabled.
+
+// Readiness is the state of each part the proxy needs before it is ready
+type Readiness struct {
+	EBPF         bool `json:"ebpf"`
+	Certificates bool `json:"certificates"`
+	Listeners    bool `json:"listeners"`
+	Ready        bool `json:"ready"`
+}
+
+var readiness struct {
+	sync.Mutex
+	state Readiness
+}
+
+// setReadiness updates the readiness state
+func setReadiness(update func(*Readiness)) {
+	readiness.Lock()
+	defer readiness.Unlock()
+	update(&readiness.state)
+	s := &readiness.state
+	s.Ready = s.EBPF && s.Certificates && s.Listeners
+}
+
+// currentReadiness returns the readiness state
+func currentReadiness() Readiness {
+	readiness.Lock()
+	defer readiness.Unlock()
+	return readiness.state
+}
+
+// serveReadyz returns the readiness state, with a 503 until we are ready
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	state := currentReadiness()
+	if !state.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, state)
+}
+
+// serveHealthz only says that we are running
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// startHealthServer serves /healthz and /readyz on address until ctx is done
+func startHealthServer(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", serveReadyz)
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Infof("health endpoint http://%s/readyz", address)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("health endpoint failed: %v", err)
+	}
+}